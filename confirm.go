@@ -0,0 +1,150 @@
+// Copyright 2018 Sergey Grankin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sgrankin/s3-purge-bucket/s3util"
+)
+
+// target is a single bucket/prefix pair to purge, resolved before any
+// destructive action is taken.
+type target struct {
+	bucket string
+	prefix string
+	region string
+
+	sample s3util.Sample // of versions and delete markers under the prefix
+}
+
+// resolveTargets parses the URLs and probes each bucket for its region, which
+// the client uses for all further requests to it, and a sample of the objects
+// under the prefix.  Failing to probe any bucket is fatal so that typos are
+// caught before anything is deleted.
+func resolveTargets(rawurls []string) []target {
+	regions := make(map[string]string)
+	targets := make([]target, 0, len(rawurls))
+	for _, rawurl := range rawurls {
+		bucket, prefix := splitS3URL(rawurl)
+
+		loc, ok := regions[bucket]
+		if !ok {
+			var err error
+			loc, err = client.BucketRegion(context.Background(), bucket)
+			if err != nil {
+				s3util.LogFatal("locate_failed", s3util.Fields{"bucket": bucket, "error": err}, "can't locate bucket %s: %v", bucket, err)
+			}
+			regions[bucket] = loc
+		}
+
+		sample, err := client.SampleObjectVersions(context.Background(), bucket, prefix)
+		if err != nil {
+			s3util.LogFatal("list_failed", s3util.Fields{"bucket": bucket, "prefix": prefix, "error": err},
+				"can't list %s/%s: %v", bucket, prefix, err)
+		}
+
+		targets = append(targets, target{
+			bucket: bucket,
+			prefix: prefix,
+			region: loc,
+			sample: sample,
+		})
+	}
+	return targets
+}
+
+func printPlan(w io.Writer, targets []target) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "BUCKET\tPREFIX\tREGION\tVERSIONS")
+	for _, t := range targets {
+		count := fmt.Sprint(t.sample.Count)
+		if t.sample.Truncated {
+			count += "+"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", t.bucket, "/"+t.prefix, t.region, count)
+	}
+	tw.Flush()
+}
+
+// mustConfirm requires the user to type back the names of every bucket that
+// will be purged, and exits unless they match.  Running without a terminal on
+// stdin is refused outright, since there is nobody to confirm.
+func mustConfirm(in *os.File, out io.Writer, targets []target) {
+	if !isTerminal(in) {
+		s3util.LogFatal("confirm_failed", nil, "stdin is not a terminal; pass -yes to purge without confirmation")
+	}
+	if err := confirm(in, out, targets); err != nil {
+		s3util.LogFatal("confirm_failed", s3util.Fields{"buckets": bucketNames(targets), "error": err}, "%v", err)
+	}
+}
+
+// confirm tells the user what will be done to the targets and reads back the
+// names of their buckets, in any order, returning an error unless they match.
+func confirm(in io.Reader, out io.Writer, targets []target) error {
+	want := bucketNames(targets)
+	if *onlyMultipart {
+		fmt.Fprintf(out, "\nMatching multipart uploads will be aborted; objects and buckets will be kept.\n")
+	} else if newFilter != nil {
+		fmt.Fprintf(out, "\nMatching versions will be deleted; the buckets will be kept.\n")
+	} else if !removingBuckets() {
+		fmt.Fprintf(out, "\nAll listed versions and uploads initiated before %s will be deleted; the buckets will be kept.\n",
+			uploadCutoff.Format(time.RFC3339))
+	} else {
+		fmt.Fprintf(out, "\nAll listed versions will be deleted and the buckets removed.\n")
+	}
+	if *teardown {
+		fmt.Fprintf(out, "Bucket configuration will be saved to %s and removed first.\n", *snapshotDir)
+	}
+	fmt.Fprintf(out, "Type the bucket name(s) to confirm: ")
+
+	line, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return fmt.Errorf("reading confirmation: %v", err)
+	}
+	got := uniqueSorted(strings.Fields(line))
+
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		return fmt.Errorf("confirmation %q does not match buckets %q; aborting", got, want)
+	}
+	return nil
+}
+
+func bucketNames(targets []target) []string {
+	names := make([]string, 0, len(targets))
+	for _, t := range targets {
+		names = append(names, t.bucket)
+	}
+	return uniqueSorted(names)
+}
+
+func uniqueSorted(ss []string) []string {
+	sort.Strings(ss)
+	out := ss[:0]
+	for i, s := range ss {
+		if i == 0 || s != ss[i-1] {
+			out = append(out, s)
+		}
+	}
+	return out
+}
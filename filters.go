@@ -0,0 +1,277 @@
+// Copyright 2018 Sergey Grankin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sgrankin/s3-purge-bucket/s3util"
+)
+
+var (
+	olderThan = flag.String("older-than", "", "only delete versions older than this age, e.g. 30d or 12h")
+	newerThan = flag.String("newer-than", "", "only delete versions newer than this age, e.g. 30d or 12h")
+	before    = flag.String("before", "", "only delete versions last modified before this RFC 3339 time")
+	after     = flag.String("after", "", "only delete versions last modified after this RFC 3339 time")
+	mode      = flag.String("mode", modeAll, "which versions to delete: "+strings.Join(modes, ", "))
+	keepN     = flag.Int("keep-versions", 0, "keep this many of the newest versions of every key")
+
+	storageClasses = flag.String("storage-class", "", "only delete object versions in these comma-separated storage classes, e.g. GLACIER,DEEP_ARCHIVE")
+	minSize        = flag.String("min-size", "", "only delete object versions of at least this size, e.g. 0, 512, 10KiB, 1G")
+	maxSize        = flag.String("max-size", "", "only delete object versions of at most this size")
+
+	includes, excludes stringList
+	includeRules       []*s3util.KeyRule
+	excludeRules       []*s3util.KeyRule
+	keyRules           []*s3util.KeyRule // every include and exclude rule, for reporting
+)
+
+func init() {
+	flag.Var(&includes, "include", "only delete keys matching this glob, or RE2 regexp if prefixed with 're:' (repeatable)")
+	flag.Var(&excludes, "exclude", "never delete keys matching this glob, or RE2 regexp if prefixed with 're:' (repeatable)")
+}
+
+// stringList is a repeatable string flag.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+const (
+	modeAll                  = "all"
+	modeNoncurrent           = "noncurrent"
+	modeDeleteMarkers        = "delete-markers"         // noncurrent delete markers, which hide nothing
+	modeExpiredDeleteMarkers = "expired-delete-markers" // delete markers that are the only version of their key
+)
+
+var modes = []string{modeAll, modeNoncurrent, modeDeleteMarkers, modeExpiredDeleteMarkers}
+
+// buildFilters returns a constructor for the filter selected by flags,
+// relative to now, or nil if nothing is filtered.  Some filters keep state
+// while listing, so each lister must construct its own.
+func buildFilters(now time.Time) (func() s3util.Filter, error) {
+	var filters []s3util.Filter
+
+	switch *mode {
+	case modeAll:
+	case modeNoncurrent:
+		filters = append(filters, s3util.Noncurrent)
+	case modeDeleteMarkers:
+		// A latest delete marker hides the version before it; deleting it
+		// would bring that version back.
+		filters = append(filters, s3util.DeleteMarkers, s3util.Noncurrent)
+	case modeExpiredDeleteMarkers:
+		// expired markers are further narrowed by the lister
+		filters = append(filters, s3util.DeleteMarkers)
+	default:
+		return nil, fmt.Errorf("-mode: unknown mode %q", *mode)
+	}
+
+	if *olderThan != "" {
+		age, err := parseAge(*olderThan)
+		if err != nil {
+			return nil, fmt.Errorf("-older-than: %v", err)
+		}
+		filters = append(filters, s3util.ModifiedBefore(now.Add(-age)))
+	}
+	if *newerThan != "" {
+		age, err := parseAge(*newerThan)
+		if err != nil {
+			return nil, fmt.Errorf("-newer-than: %v", err)
+		}
+		filters = append(filters, s3util.ModifiedAfter(now.Add(-age)))
+	}
+	if *before != "" {
+		t, err := time.Parse(time.RFC3339, *before)
+		if err != nil {
+			return nil, fmt.Errorf("-before: %v", err)
+		}
+		filters = append(filters, s3util.ModifiedBefore(t))
+	}
+	if *after != "" {
+		t, err := time.Parse(time.RFC3339, *after)
+		if err != nil {
+			return nil, fmt.Errorf("-after: %v", err)
+		}
+		filters = append(filters, s3util.ModifiedAfter(t))
+	}
+
+	if *storageClasses != "" {
+		filters = append(filters, s3util.StorageClasses(strings.Split(*storageClasses, ",")...))
+	}
+	if *minSize != "" {
+		n, err := parseSize(*minSize)
+		if err != nil {
+			return nil, fmt.Errorf("-min-size: %v", err)
+		}
+		filters = append(filters, s3util.SizeAtLeast(n))
+	}
+	if *maxSize != "" {
+		n, err := parseSize(*maxSize)
+		if err != nil {
+			return nil, fmt.Errorf("-max-size: %v", err)
+		}
+		filters = append(filters, s3util.SizeAtMost(n))
+	}
+
+	if len(includes) > 0 {
+		rules, err := newKeyRules(includes)
+		if err != nil {
+			return nil, fmt.Errorf("-include: %v", err)
+		}
+		includeRules = rules
+	}
+	if len(excludes) > 0 {
+		rules, err := newKeyRules(excludes)
+		if err != nil {
+			return nil, fmt.Errorf("-exclude: %v", err)
+		}
+		excludeRules = rules
+	}
+
+	if *keepN < 0 {
+		return nil, fmt.Errorf("-keep-versions: must not be negative")
+	}
+
+	if len(filters) == 0 && len(keyRules) == 0 && *keepN == 0 {
+		return nil, nil
+	}
+	return func() s3util.Filter {
+		f := s3util.AllOf(filters...)
+		if *keepN > 0 {
+			f = s3util.AllOf(append([]s3util.Filter{s3util.KeepNewest(*keepN)}, filters...)...)
+		}
+		if len(keyRules) == 0 {
+			return f
+		}
+		// The key rules see every version, so that their counts don't
+		// depend on the other filters.
+		var keys []s3util.Filter
+		if len(includeRules) > 0 {
+			keys = append(keys, s3util.Include(includeRules))
+		}
+		if len(excludeRules) > 0 {
+			keys = append(keys, s3util.Exclude(excludeRules))
+		}
+		return s3util.EachOf(append(keys, f)...)
+	}, nil
+}
+
+func newKeyRules(patterns []string) ([]*s3util.KeyRule, error) {
+	rules := make([]*s3util.KeyRule, 0, len(patterns))
+	for _, p := range patterns {
+		r, err := s3util.NewKeyRule(p)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	keyRules = append(keyRules, rules...)
+	return rules, nil
+}
+
+// uploadKeys returns whether an upload of key may be aborted under the
+// -include and -exclude rules, or nil if there are none.
+func uploadKeys() func(key string) bool {
+	if len(keyRules) == 0 {
+		return nil
+	}
+	return func(key string) bool {
+		return (len(includeRules) == 0 || matchAny(includeRules, key)) && !matchAny(excludeRules, key)
+	}
+}
+
+func matchAny(rules []*s3util.KeyRule, key string) bool {
+	for _, r := range rules {
+		if r.Match(key) {
+			return true
+		}
+	}
+	return false
+}
+
+func logKeyRules() {
+	for _, r := range keyRules {
+		s3util.LogInfo("rule_matches", s3util.Fields{"rule": r.Pattern, "count": r.Matches()},
+			"rule %q matched %d keys", r.Pattern, r.Matches())
+	}
+}
+
+// parseSize parses a byte count with an optional unit suffix, like "512",
+// "512B", "10K", "10KB", "10KiB" or "1g".  Units are binary and case
+// insensitive.
+func parseSize(s string) (int64, error) {
+	i := strings.IndexFunc(s, func(r rune) bool { return r < '0' || r > '9' })
+	if i < 0 {
+		i = len(s)
+	}
+	n, err := strconv.ParseInt(s[:i], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	shift, ok := sizeUnits[strings.ToLower(s[i:])]
+	if !ok {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	if n > math.MaxInt64>>shift {
+		return 0, fmt.Errorf("size %q is too large", s)
+	}
+	return n << shift, nil
+}
+
+// sizeUnits maps the lowercased unit suffixes of sizes to their shift.
+var sizeUnits = map[string]uint{
+	"": 0, "b": 0,
+	"k": 10, "kb": 10, "kib": 10,
+	"m": 20, "mb": 20, "mib": 20,
+	"g": 30, "gb": 30, "gib": 30,
+	"t": 40, "tb": 40, "tib": 40,
+}
+
+// parseAge parses a duration that may start with a count of days, like "30d"
+// or "1d12h".
+func parseAge(s string) (time.Duration, error) {
+	var age time.Duration
+	if i := strings.IndexByte(s, 'd'); i >= 0 {
+		days, err := strconv.Atoi(s[:i])
+		if err != nil {
+			return 0, fmt.Errorf("invalid age %q", s)
+		}
+		age = time.Duration(days) * 24 * time.Hour
+		s = s[i+1:]
+	}
+	if s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return 0, err
+		}
+		age += d
+	}
+	if age < 0 {
+		return 0, fmt.Errorf("negative age %v", age)
+	}
+	return age, nil
+}
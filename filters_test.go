@@ -0,0 +1,187 @@
+// Copyright 2018 Sergey Grankin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"testing"
+	"time"
+
+	"github.com/sgrankin/s3-purge-bucket/s3util"
+)
+
+func TestParseSize(t *testing.T) {
+	for _, tc := range []struct {
+		s    string
+		want int64
+		ok   bool
+	}{
+		{"0", 0, true},
+		{"512", 512, true},
+		{"512B", 512, true},
+		{"10K", 10 << 10, true},
+		{"10KB", 10 << 10, true},
+		{"10KiB", 10 << 10, true},
+		{"10kib", 10 << 10, true},
+		{"1g", 1 << 30, true},
+		{"1gib", 1 << 30, true},
+		{"1GiB", 1 << 30, true},
+		{"2T", 2 << 40, true},
+		{"8388607T", 8388607 << 40, true},
+		{"8388608T", 0, false}, // overflows
+		{"9999999999999T", 0, false},
+		{"99999999999999999999", 0, false},
+		{"10iB", 0, false},
+		{"10Ki", 0, false},
+		{"10KiBB", 0, false},
+		{"10P", 0, false},
+		{"", 0, false},
+		{"K", 0, false},
+		{"-1", 0, false},
+		{"1.5G", 0, false},
+	} {
+		got, err := parseSize(tc.s)
+		if (err == nil) != tc.ok || got != tc.want {
+			t.Errorf("parseSize(%q) = %d, %v, want %d (ok %v)", tc.s, got, err, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestParseAge(t *testing.T) {
+	for _, tc := range []struct {
+		s    string
+		want time.Duration
+		ok   bool
+	}{
+		{"30d", 30 * 24 * time.Hour, true},
+		{"12h", 12 * time.Hour, true},
+		{"1d12h", 36 * time.Hour, true},
+		{"0d", 0, true},
+		{"1d-1h", 23 * time.Hour, true},
+		{"d", 0, false},
+		{"1.5d", 0, false},
+		{"-1d", 0, false},
+		{"-1h", 0, false},
+		{"1w", 0, false},
+		{"", 0, true},
+	} {
+		got, err := parseAge(tc.s)
+		if (err == nil) != tc.ok || got != tc.want {
+			t.Errorf("parseAge(%q) = %v, %v, want %v (ok %v)", tc.s, got, err, tc.want, tc.ok)
+		}
+	}
+}
+
+// setFilterFlags sets the filter flags from args, and returns a function that
+// restores them.
+func setFilterFlags(t *testing.T, args ...string) func() {
+	t.Helper()
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	flag.VisitAll(func(f *flag.Flag) { fs.Var(f.Value, f.Name, f.Usage) })
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return func() {
+		fs.Visit(func(f *flag.Flag) {
+			if _, ok := f.Value.(*stringList); !ok {
+				f.Value.Set(flag.Lookup(f.Name).DefValue)
+			}
+		})
+		includes, excludes = nil, nil
+		includeRules, excludeRules, keyRules = nil, nil, nil
+	}
+}
+
+func TestBuildFilters(t *testing.T) {
+	now := time.Date(2018, 6, 1, 0, 0, 0, 0, time.UTC)
+	daysAgo := func(days int) time.Time { return now.Add(-time.Duration(days) * 24 * time.Hour) }
+
+	// Versions of two keys, in listing order.
+	versions := []s3util.Version{
+		{Key: "a.tmp", VersionId: "1", IsLatest: true, DeleteMarker: true, LastModified: daysAgo(1)},
+		{Key: "a.tmp", VersionId: "2", LastModified: daysAgo(10), Size: 100},
+		{Key: "a.tmp", VersionId: "3", LastModified: daysAgo(40), Size: 10, StorageClass: "GLACIER"},
+		{Key: "a.tmp", VersionId: "4", DeleteMarker: true, LastModified: daysAgo(50)},
+		{Key: "a.tmp", VersionId: "5", LastModified: daysAgo(60), Size: 1000},
+		{Key: "keep/b.tmp", VersionId: "6", IsLatest: true, LastModified: daysAgo(45), Size: 5},
+		{Key: "keep/b.tmp", VersionId: "7", LastModified: daysAgo(70), Size: 5},
+	}
+
+	for _, tc := range []struct {
+		args []string
+		want string // selected version IDs, or "all" for no filter
+	}{
+		{nil, "all"},
+		{[]string{"-older-than", "30d"}, "34567"},
+		{[]string{"-newer-than", "30d"}, "12"},
+		{[]string{"-before", "2018-04-20T00:00:00Z"}, "4567"},
+		{[]string{"-after", "2018-04-20T00:00:00Z"}, "123"},
+		{[]string{"-mode", "noncurrent"}, "23457"},
+		{[]string{"-mode", "delete-markers"}, "4"},
+		{[]string{"-mode", "expired-delete-markers"}, "14"}, // narrowed further by the purge
+		{[]string{"-storage-class", "GLACIER,DEEP_ARCHIVE"}, "3"},
+		{[]string{"-min-size", "100"}, "25"},
+		{[]string{"-max-size", "10"}, "367"},
+		{[]string{"-keep-versions", "1"}, "3457"},
+		// The newest version of each key is kept before the age filter
+		// applies, not the newest version older than 30 days.
+		{[]string{"-keep-versions", "1", "-older-than", "30d"}, "3457"},
+		{[]string{"-keep-versions", "1", "-max-size", "10"}, "37"},
+		{[]string{"-include", "**/*.tmp"}, "1234567"},
+		{[]string{"-include", "*.tmp"}, "12345"},
+		{[]string{"-exclude", "keep/**"}, "12345"},
+		{[]string{"-include", "re:^keep/", "-older-than", "60d"}, "7"},
+	} {
+		reset := setFilterFlags(t, tc.args...)
+		newFilter, err := buildFilters(now)
+		if err != nil {
+			t.Errorf("%q: %v", tc.args, err)
+			reset()
+			continue
+		}
+		got := "all"
+		if newFilter != nil {
+			got = ""
+			for _, v := range newFilter().Select(versions) {
+				got += v.VersionId
+			}
+		}
+		if got != tc.want {
+			t.Errorf("%q selected %q, want %q", tc.args, got, tc.want)
+		}
+		reset()
+	}
+}
+
+func TestBuildFiltersErrors(t *testing.T) {
+	for _, args := range [][]string{
+		{"-mode", "bogus"},
+		{"-older-than", "soon"},
+		{"-newer-than", "-1d"},
+		{"-before", "2018-01-01"},
+		{"-after", "yesterday"},
+		{"-min-size", "10iB"},
+		{"-max-size", "9999999999999T"},
+		{"-include", "re:("},
+		{"-exclude", "re:["},
+		{"-keep-versions", "-1"},
+	} {
+		reset := setFilterFlags(t, args...)
+		if _, err := buildFilters(time.Now()); err == nil {
+			t.Errorf("%q: no error", args)
+		}
+		reset()
+	}
+}
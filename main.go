@@ -15,29 +15,57 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
+	"net/http"
 	"net/url"
 	"os"
 	"strings"
-	"sync"
 	"time"
 
-	"github.com/aws/aws-sdk-go-v2/service/s3"
-	"github.com/rcrowley/go-metrics"
 	"github.com/sgrankin/s3-purge-bucket/s3util"
 )
 
 var (
 	s3URLs        []string
-	countDeleters = flag.Int("workers", 64, "count of concurrent deleter workers")
-	region        = flag.String("region", "us-east-1", "AWS Region")
+	countDeleters = flag.Int("workers", 64, "initial count of concurrent delete requests")
+	minDeleters   = flag.Int("min-workers", 4, "minimum count of concurrent delete requests")
+	maxDeleters   = flag.Int("max-workers", 512, "maximum count of concurrent delete requests")
+	countListers  = flag.Int("listers", 16, "maximum count of concurrent listers; key ranges are split automatically to keep them busy")
+	region        = flag.String("region", "us-east-1", "default AWS region; each bucket is accessed in its own region")
 	dryrun        = flag.Bool("dryrun", false, "skip any destructive actions")
+	yes           = flag.Bool("yes", false, "skip the interactive confirmation; required when stdin is not a terminal")
 
-	client *s3util.S3
+	maxDeletesPerSec   = flag.Float64("max-deletes-per-sec", 0, "limit deleted objects per second (0 for unlimited)")
+	maxListsPerSec     = flag.Float64("max-lists-per-sec", 0, "limit list requests per second (0 for unlimited)")
+	rateLimitPerBucket = flag.Bool("rate-limit-per-bucket", false, "apply the rate limits to each bucket separately")
+	rateLimitDepth     = flag.Int("rate-limit-prefix-depth", 0, "apply the rate limits to each key prefix of up to this many directories separately")
 
-	statObjsQueued = metrics.NewRegisteredCounter("objs_queued", nil)
+	endpointURL = flag.String("endpoint-url", "", "URL of an S3-compatible store to use instead of AWS, e.g. http://localhost:9000")
+	pathStyle   = flag.Bool("path-style", false, "address buckets as URL paths rather than host names, as most S3-compatible stores require")
+	skipVerify  = flag.Bool("insecure-skip-verify", false, "don't verify the endpoint's TLS certificate")
+	caBundle    = flag.String("ca-bundle", "", "PEM file of CA certificates to trust for the endpoint")
+
+	checkpointPath   = flag.String("checkpoint", "", "periodically save listing progress to this file")
+	checkpointPeriod = flag.Duration("checkpoint-interval", 30*time.Second, "how often to save the checkpoint")
+	resumePath       = flag.String("resume", "", "resume from a checkpoint file; progress is saved back to it unless -checkpoint is given")
+
+	auditPath    = flag.String("audit-log", "", "append a JSON record of every deleted and failed version to this file")
+	auditGzip    = flag.Bool("audit-log-gzip", false, "gzip-compress the audit log")
+	auditMaxSize = flag.String("audit-log-max-size", "", "rotate the audit log once it reaches this size, e.g. 100M")
+
+	showProgress = flag.Bool("progress", true, "show a live progress line instead of logging metrics periodically when stdout is a terminal")
+	logFormat    = flag.String("log-format", "text", "log as plain `text` or as JSON objects, one per line (json)")
+	logLevel     = flag.String("log-level", "debug", "log events of at least this `level`: debug, info (no per-lister progress) or error")
+	metricsAddr  = flag.String("metrics-addr", "", "serve Prometheus metrics at /metrics on this address, e.g. :9090")
+	drainTimeout = flag.Duration("drain-timeout", 30*time.Second, "after an interrupt, how long to let in-flight deletes finish")
+
+	client     *s3util.S3
+	auditLog   *s3util.AuditLog // nil unless -audit-log is set
+	controller *s3util.Controller
+	newFilter  func() s3util.Filter // nil unless some filter flag is set
 )
 
 const (
@@ -51,11 +79,6 @@ Options:
 `
 )
 
-type deleteRequest struct {
-	bucket  string
-	objects []s3.ObjectIdentifier
-}
-
 func init() {
 	log.SetFlags(log.Ldate | log.Lmicroseconds)
 
@@ -63,96 +86,216 @@ func init() {
 		fmt.Fprintf(flag.CommandLine.Output(), strings.TrimSpace(usageFmt)+"\n", os.Args[0])
 		flag.PrintDefaults()
 	}
+}
+
+// configure parses the command line and sets up the client.
+func configure() {
 	flag.Parse()
 
+	if err := s3util.SetLogFormat(*logFormat); err != nil {
+		s3util.LogFatal("usage", s3util.Fields{"error": err}, "-log-format: %v", err)
+	}
+	level, err := s3util.ParseLevel(*logLevel)
+	if err != nil {
+		s3util.LogFatal("usage", s3util.Fields{"error": err}, "-log-level: %v", err)
+	}
+	s3util.SetLogLevel(level)
+
 	s3URLs = flag.Args()
 	if len(s3URLs) == 0 {
 		flag.Usage()
 		os.Exit(1)
 	}
 
-	client = s3util.MustNewClient(*region)
+	if *dryrun && *checkpointPath != "" {
+		s3util.LogFatal("usage", nil, "-checkpoint would record deletes that -dryrun skips")
+	}
+	if *resumePath != "" && *checkpointPath == "" && !*dryrun {
+		*checkpointPath = *resumePath
+	}
+
+	now := time.Now()
+	if newFilter, err = buildFilters(now); err != nil {
+		s3util.LogFatal("usage", s3util.Fields{"error": err}, "%v", err)
+	}
+	if *uploadsOlderThan != "" {
+		age, err := parseAge(*uploadsOlderThan)
+		if err != nil {
+			s3util.LogFatal("usage", s3util.Fields{"error": err}, "-uploads-older-than: %v", err)
+		}
+		uploadCutoff = now.Add(-age)
+	}
+
+	client = s3util.MustNewClient(*region, s3util.Endpoint{
+		URL:                *endpointURL,
+		PathStyle:          *pathStyle,
+		InsecureSkipVerify: *skipVerify,
+		CABundle:           *caBundle,
+	})
+	if *maxDeletesPerSec > 0 || *maxListsPerSec > 0 {
+		client.Limits = &s3util.RateLimits{
+			DeletesPerSec: *maxDeletesPerSec,
+			ListsPerSec:   *maxListsPerSec,
+			PerBucket:     *rateLimitPerBucket,
+			PrefixDepth:   *rateLimitDepth,
+		}
+	}
+	controller = s3util.NewController(*countDeleters, *minDeleters, *maxDeleters)
+	client.OnThrottle = controller.Throttled
+	client.OnDeleteRoundTrip = controller.Observe
+
+	if *auditPath != "" {
+		opts := s3util.AuditLogOptions{Gzip: *auditGzip}
+		if *auditMaxSize != "" {
+			if opts.MaxSize, err = parseSize(*auditMaxSize); err != nil {
+				s3util.LogFatal("usage", s3util.Fields{"error": err}, "-audit-log-max-size: %v", err)
+			}
+		}
+		if auditLog, err = s3util.OpenAuditLog(*auditPath, opts); err != nil {
+			s3util.LogFatal("audit_failed", s3util.Fields{"path": *auditPath, "error": err}, "opening audit log: %v", err)
+		}
+		client.Audit = auditLog.Record
+	}
 }
 
 func main() {
-	log.Printf("deleting all objects in paths %v", s3URLs)
+	configure()
+	targets := resolveTargets(s3URLs)
+	if err := checkTeardown(targets); err != nil {
+		s3util.LogFatal("usage", s3util.Fields{"error": err}, "%v", err)
+	}
+	printPlan(os.Stderr, targets)
+	if !*dryrun && !*yes {
+		mustConfirm(os.Stdin, os.Stderr, targets)
+	}
 
-	go metricsLogger(3 * time.Second)
-	purgeBuckets(s3URLs)
-	s3util.LogMetrics() // log final metrics
+	s3util.LogInfo("purge_started", s3util.Fields{"urls": s3URLs}, "deleting all objects in paths %v", s3URLs)
+
+	ctx := handleSignals(*drainTimeout)
+	var display *progress
+	if *showProgress && isTerminal(os.Stdout) {
+		display = newProgress(os.Stdout, os.Stderr, targets)
+		log.SetOutput(display)
+		go display.run(time.Second)
+	} else {
+		go metricsLogger(3 * time.Second)
+	}
+	if *metricsAddr != "" {
+		go serveMetrics(*metricsAddr)
+	}
+	if *teardown {
+		teardownBuckets(ctx, targets)
+	}
+	if !purgeBuckets(ctx, targets, display) {
+		s3util.LogInfo("purge_interrupted", nil, "interrupted; buckets were not removed")
+		os.Exit(1)
+	}
 }
 
 func metricsLogger(period time.Duration) {
 	for _ = range time.Tick(period) {
-		s3util.LogMetrics()
+		logMetrics()
 	}
 }
 
-func purgeBuckets(rawurls []string) {
-	var listers, deleters sync.WaitGroup
-	queue := make(chan *deleteRequest, *countDeleters)
-
-	buckets := make(map[string]bool)
-	for _, rawurl := range rawurls {
-		bucket, path := splitS3URL(rawurl)
-		buckets[bucket] = true
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", s3util.MetricsHandler())
+	s3util.LogInfo("metrics_serving", s3util.Fields{"addr": addr}, "serving metrics on %s/metrics", addr)
+	err := http.ListenAndServe(addr, mux)
+	closeAuditLog()
+	s3util.LogFatal("metrics_failed", s3util.Fields{"addr": addr, "error": err}, "serving metrics: %v", err)
+}
 
-		listers.Add(1)
-		go func(bucket string, prefix string) {
-			defer listers.Done()
-			lister(bucket, prefix, queue)
-		}(bucket, path)
+// closeAuditLog closes the audit log, if any, so that it is complete even if
+// the process exits while deletes are in flight.  It is safe to call again.
+func closeAuditLog() {
+	if auditLog == nil {
+		return
 	}
-
-	for i := 0; i < *countDeleters; i++ {
-		deleters.Add(1)
-		go func() {
-			defer deleters.Done()
-			deleter(queue)
-		}()
+	if err := auditLog.Close(); err != nil {
+		s3util.LogError("audit_failed", s3util.Fields{"path": *auditPath, "error": err}, "closing audit log: %v", err)
 	}
+}
 
-	listers.Wait()
-	close(queue)
-	deleters.Wait()
-
-	if !*dryrun {
-		for bucket := range buckets {
-			log.Printf("removing bucket %s", bucket)
-			client.MustDeleteBucket(bucket)
-		}
+func logMetrics() {
+	if err := s3util.LogMetrics(); err != nil {
+		s3util.LogError("metrics_failed", s3util.Fields{"error": err}, "%v", err)
 	}
 }
 
-func lister(bucket, prefix string, queue chan<- *deleteRequest) {
-	log.Printf("listing %s/%s", bucket, prefix)
-	client.MustListObjectVersions(bucket, prefix, func(objects []s3.ObjectIdentifier) {
-		statObjsQueued.Inc(int64(len(objects)))
-		queue <- &deleteRequest{
-			bucket:  bucket,
-			objects: objects,
+// purgeBuckets deletes everything under the targets and then the buckets
+// themselves, and reports whether it ran to completion.  Progress is shown on
+// display, if not nil, which is finished once the purge returns.
+func purgeBuckets(ctx context.Context, targets []target, display *progress) bool {
+	opts := s3util.PurgeOptions{
+		Store:                  client,
+		Controller:             controller,
+		Listers:                *countListers,
+		DryRun:                 *dryrun,
+		NewFilter:              newFilter,
+		ExpiredDeleteMarkers:   *mode == modeExpiredDeleteMarkers,
+		SkipObjects:            *onlyMultipart,
+		AbortUploads:           abortingUploads(),
+		UploadsInitiatedBefore: uploadCutoff,
+		UploadKeys:             uploadKeys(),
+		RemoveBuckets:          removingBuckets(),
+		Checkpoint:             *checkpointPath,
+		CheckpointInterval:     *checkpointPeriod,
+		DrainTimeout:           *drainTimeout,
+	}
+	if display != nil {
+		opts.OnEvent = display.onEvent
+	}
+	if *resumePath != "" {
+		var err error
+		if opts.Resume, err = s3util.LoadCheckpoint(*resumePath); err != nil {
+			s3util.LogFatal("checkpoint_failed", s3util.Fields{"path": *resumePath, "error": err}, "loading checkpoint: %v", err)
 		}
-	})
-	log.Printf("finished listing %s/%s", bucket, prefix)
-}
+	}
 
-func deleter(in <-chan *deleteRequest) {
-	for req := range in {
-		statObjsQueued.Dec(int64(len(req.objects)))
-		if !*dryrun {
-			client.MustDeleteObjectVersions(req.bucket, req.objects)
+	purgeTargets := make([]s3util.Target, len(targets))
+	for i, t := range targets {
+		purgeTargets[i] = s3util.Target{Bucket: t.bucket, Prefix: t.prefix}
+	}
+	result, err := s3util.NewPurger(opts).Purge(ctx, purgeTargets)
+	closeAuditLog()
+	if display != nil {
+		display.finish()
+		log.SetOutput(os.Stderr)
+	}
+	logMetrics() // log final metrics
+	logKeyRules()
+	logDeletedBytes(result, *dryrun)
+	if err != nil {
+		s3util.LogFatal("purge_failed", s3util.Fields{"error": err}, "%v", err)
+	}
+
+	if !result.Completed {
+		for _, st := range result.Checkpoint.Listers {
+			if !st.Done {
+				s3util.LogInfo("range_incomplete", s3util.Fields{"bucket": st.Bucket, "prefix": st.Prefix,
+					"deleted": st.Deleted, "listed": st.Listed, "key_marker": st.KeyMarker},
+					"stopped %s/%s after deleting %d of %d listed; resume after key %q",
+					st.Bucket, st.Prefix, st.Deleted, st.Listed, st.KeyMarker)
+			}
 		}
+		return false
+	}
+	if !opts.RemoveBuckets {
+		s3util.LogInfo("buckets_kept", nil, "filters are active; not removing buckets")
 	}
+	return true
 }
 
 func splitS3URL(rawurl string) (bucket, prefix string) {
 	u, err := url.Parse(rawurl)
 	if err != nil {
-		log.Fatalf("error: can't parse URL '%s'", rawurl)
+		s3util.LogFatal("usage", s3util.Fields{"url": rawurl, "error": err}, "can't parse URL '%s'", rawurl)
 	}
 
 	if u.Scheme != "s3" {
-		log.Fatalf("error: URL scheme must be s3 in URL '%s'", u)
+		s3util.LogFatal("usage", s3util.Fields{"url": rawurl}, "URL scheme must be s3 in URL '%s'", u)
 	}
 
 	return u.Host, strings.TrimLeft(u.Path, "/")
@@ -0,0 +1,241 @@
+// Copyright 2018 Sergey Grankin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sgrankin/s3-purge-bucket/s3util"
+	"github.com/sgrankin/s3-purge-bucket/s3util/s3test"
+)
+
+func TestMain(m *testing.M) {
+	// The fake does not check signatures, but the SDK needs credentials to sign.
+	os.Setenv("AWS_ACCESS_KEY_ID", "test")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	os.Exit(m.Run())
+}
+
+// newFake returns a fake holding a few versions and uploads under the keys
+// keep/N and drop/N of each bucket.
+func newFake(buckets ...string) *s3test.Server {
+	srv := s3test.NewServer()
+	for _, bucket := range buckets {
+		srv.CreateBucket(bucket, "us-east-1")
+		for i := 0; i < 20; i++ {
+			for _, dir := range []string{"keep", "drop"} {
+				key := fmt.Sprintf("%s/%02d", dir, i)
+				srv.Put(bucket, s3test.Object{Key: key, Size: 100})
+				srv.Put(bucket, s3test.Object{Key: key, Size: 100})
+				if i%5 == 0 {
+					srv.Put(bucket, s3test.Object{Key: key, DeleteMarker: true})
+				}
+			}
+		}
+		srv.CreateUpload(bucket, "keep/upload", time.Now())
+		srv.CreateUpload(bucket, "drop/upload", time.Now())
+	}
+	srv.SetPageSize(7)
+	return srv
+}
+
+// runConfigure runs configure on the command line args, pointed at srv, and
+// returns a function that resets the flags and globals it set.
+func runConfigure(t *testing.T, srv *s3test.Server, args ...string) func() {
+	t.Helper()
+	oldArgs := os.Args
+	os.Args = append([]string{"s3-purge-bucket", "-endpoint-url", srv.URL, "-path-style", "-log-level", "error"}, args...)
+	configure()
+	client.Retry.BaseDelay = time.Millisecond
+	client.Retry.MaxDelay = 5 * time.Millisecond
+	return func() {
+		os.Args = oldArgs
+		flag.VisitAll(func(f *flag.Flag) {
+			if _, ok := f.Value.(*stringList); !ok && !strings.HasPrefix(f.Name, "test.") {
+				f.Value.Set(f.DefValue)
+			}
+		})
+		includes, excludes = nil, nil
+		includeRules, excludeRules, keyRules = nil, nil, nil
+		newFilter, uploadCutoff = nil, time.Time{}
+		client, controller, auditLog = nil, nil, nil
+		s3util.SetLogLevel(s3util.LevelDebug)
+	}
+}
+
+func TestResolveTargets(t *testing.T) {
+	srv := newFake("one", "two")
+	defer srv.Close()
+	srv.SetPageSize(1000) // so the samples are complete
+	defer runConfigure(t, srv, "-yes", "s3://one/keep/", "s3://two")()
+
+	targets := resolveTargets(s3URLs)
+	want := []struct {
+		bucket, prefix string
+		count          int
+	}{
+		{"one", "keep/", 44},
+		{"two", "", 88},
+	}
+	if len(targets) != len(want) {
+		t.Fatalf("resolveTargets(%v) = %d targets, want %d", s3URLs, len(targets), len(want))
+	}
+	for i, w := range want {
+		tg := targets[i]
+		if tg.bucket != w.bucket || tg.prefix != w.prefix || tg.region != "us-east-1" {
+			t.Errorf("target %d = %s/%s in %s, want %s/%s in us-east-1", i, tg.bucket, tg.prefix, tg.region, w.bucket, w.prefix)
+		}
+		if tg.sample.Count != w.count || tg.sample.Truncated {
+			t.Errorf("target %d sampled %d versions (truncated %v), want %d", i, tg.sample.Count, tg.sample.Truncated, w.count)
+		}
+	}
+}
+
+func TestPurgeBuckets(t *testing.T) {
+	srv := newFake("one", "two")
+	defer srv.Close()
+	defer runConfigure(t, srv, "-yes", "s3://one", "s3://two")()
+
+	if !removingBuckets() {
+		t.Fatalf("removingBuckets() = false without filters")
+	}
+	if !purgeBuckets(context.Background(), resolveTargets(s3URLs), nil) {
+		t.Fatalf("purgeBuckets() = false, want true")
+	}
+	for _, bucket := range []string{"one", "two"} {
+		if srv.HasBucket(bucket) {
+			t.Errorf("bucket %s was not removed", bucket)
+		}
+	}
+}
+
+func TestPurgeBucketsKeepsFresherUploads(t *testing.T) {
+	srv := newFake("bucket")
+	defer srv.Close()
+	srv.CreateUpload("bucket", "drop/stale", time.Now().Add(-48*time.Hour))
+	defer runConfigure(t, srv, "-yes", "-uploads-older-than", "1d", "s3://bucket")()
+
+	if removingBuckets() {
+		t.Fatalf("removingBuckets() = true with -uploads-older-than")
+	}
+	if !purgeBuckets(context.Background(), resolveTargets(s3URLs), nil) {
+		t.Fatalf("purgeBuckets() = false, want true")
+	}
+	if !srv.HasBucket("bucket") {
+		t.Fatalf("bucket was removed")
+	}
+	if versions := srv.Versions("bucket"); len(versions) != 0 {
+		t.Errorf("%d versions left, want 0", len(versions))
+	}
+	var keys []string
+	for _, u := range srv.Uploads("bucket") {
+		keys = append(keys, u.Key)
+	}
+	if got := strings.Join(uniqueSorted(keys), " "); got != "drop/upload keep/upload" {
+		t.Errorf("uploads left = %s, want drop/upload keep/upload", got)
+	}
+}
+
+func TestPurgeBucketsFiltered(t *testing.T) {
+	srv := newFake("bucket")
+	defer srv.Close()
+	srv.CreateUpload("bucket", "keep/stale", time.Now().Add(-48*time.Hour))
+	srv.CreateUpload("bucket", "drop/stale", time.Now().Add(-48*time.Hour))
+	defer runConfigure(t, srv, "-yes", "-exclude", "keep/**", "-uploads-older-than", "1d", "s3://bucket")()
+
+	if removingBuckets() {
+		t.Fatalf("removingBuckets() = true with -exclude")
+	}
+	if !purgeBuckets(context.Background(), resolveTargets(s3URLs), nil) {
+		t.Fatalf("purgeBuckets() = false, want true")
+	}
+	if !srv.HasBucket("bucket") {
+		t.Fatalf("bucket was removed")
+	}
+	for _, v := range srv.Versions("bucket") {
+		if !strings.HasPrefix(v.Key, "keep/") {
+			t.Errorf("version %s of %s was not deleted", v.VersionId, v.Key)
+		}
+	}
+	if n := len(srv.Versions("bucket")); n != 44 {
+		t.Errorf("%d versions left, want 44", n)
+	}
+	var keys []string
+	for _, u := range srv.Uploads("bucket") {
+		keys = append(keys, u.Key)
+	}
+	if got, want := strings.Join(uniqueSorted(keys), " "), "drop/upload keep/stale keep/upload"; got != want {
+		t.Errorf("uploads left = %s, want %s", got, want)
+	}
+}
+
+func TestConfirm(t *testing.T) {
+	srv := newFake("one", "two")
+	defer srv.Close()
+
+	for _, tc := range []struct {
+		args  []string
+		input string
+		plan  string
+		ok    bool
+	}{
+		{nil, "one two\n", "the buckets removed", true},
+		{nil, "two one one", "the buckets removed", true},
+		{nil, "one\n", "the buckets removed", false},
+		{nil, "one two three\n", "the buckets removed", false},
+		{nil, "", "the buckets removed", false},
+		{[]string{"-uploads-older-than", "1d"}, "one two\n", "uploads initiated before", true},
+		{[]string{"-include", "keep/**"}, "one two\n", "Matching versions will be deleted", true},
+		{[]string{"-only-multipart"}, "one two\n", "Matching multipart uploads will be aborted", true},
+	} {
+		reset := runConfigure(t, srv, append(tc.args, "s3://one/keep/", "s3://two", "s3://one/drop/")...)
+		var out bytes.Buffer
+		err := confirm(strings.NewReader(tc.input), &out, resolveTargets(s3URLs))
+		if (err == nil) != tc.ok {
+			t.Errorf("confirm(%v, %q) = %v, want ok %v", tc.args, tc.input, err, tc.ok)
+		}
+		if !strings.Contains(out.String(), tc.plan) {
+			t.Errorf("confirm(%v) printed %q, want it to mention %q", tc.args, out.String(), tc.plan)
+		}
+		reset()
+	}
+}
+
+// TestConfirmRequiresTerminal runs mustConfirm in a child process, since it
+// exits when stdin is not a terminal.
+func TestConfirmRequiresTerminal(t *testing.T) {
+	if os.Getenv("PURGE_TEST_CONFIRM") != "" {
+		mustConfirm(os.Stdin, os.Stderr, []target{{bucket: "bucket"}})
+		return
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestConfirmRequiresTerminal$")
+	cmd.Env = append(os.Environ(), "PURGE_TEST_CONFIRM=1")
+	cmd.Stdin = strings.NewReader("bucket\n")
+	out, err := cmd.CombinedOutput()
+	if _, ok := err.(*exec.ExitError); !ok {
+		t.Fatalf("mustConfirm without a terminal: err = %v, want exit status; output:\n%s", err, out)
+	}
+	if !strings.Contains(string(out), "stdin is not a terminal") {
+		t.Errorf("mustConfirm without a terminal printed %q", out)
+	}
+}
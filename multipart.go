@@ -0,0 +1,41 @@
+// Copyright 2018 Sergey Grankin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"time"
+)
+
+var (
+	onlyMultipart    = flag.Bool("only-multipart", false, "only abort incomplete multipart uploads, leaving objects and buckets alone")
+	uploadsOlderThan = flag.String("uploads-older-than", "", "only abort multipart uploads initiated longer ago than this age, e.g. 7d")
+
+	uploadCutoff time.Time // zero unless -uploads-older-than is set
+)
+
+// abortingUploads reports whether multipart uploads should be aborted.  They
+// are when purging everything, and otherwise only when asked for explicitly.
+func abortingUploads() bool {
+	return *onlyMultipart || *uploadsOlderThan != "" || newFilter == nil
+}
+
+// removingBuckets reports whether the buckets should be removed once purged.
+// They are only when every version and upload is deleted, since anything left
+// behind, such as uploads newer than -uploads-older-than, keeps S3 from
+// removing them.
+func removingBuckets() bool {
+	return newFilter == nil && !*onlyMultipart && *uploadsOlderThan == ""
+}
@@ -0,0 +1,200 @@
+// Copyright 2018 Sergey Grankin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+	"github.com/sgrankin/s3-purge-bucket/s3util"
+)
+
+// clearLine returns the cursor to the start of the line and erases it.
+const clearLine = "\r\033[K"
+
+// progress keeps a status line at the bottom of a terminal, which is redrawn
+// as the purge advances.  It is also the writer for log output, which is
+// printed above the status line.
+type progress struct {
+	term  io.Writer
+	logs  io.Writer
+	start time.Time
+	total int64 // versions under the targets, if the plan saw them all, or 0
+
+	mu        sync.Mutex
+	line      string
+	listed    int64
+	selected  int64
+	deleted   int64
+	bytes     int64
+	fractions map[string]float64 // of each target's key space listed, by bucket/prefix
+
+	// At the previous refresh, for rates.
+	lastTime    time.Time
+	lastDeleted int64
+	lastRetries int64
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// newProgress returns a status line on term for a purge of targets.  Log
+// output should be redirected to it, and is written to logs.
+func newProgress(term, logs io.Writer, targets []target) *progress {
+	now := time.Now()
+	p := &progress{
+		term:      term,
+		logs:      logs,
+		start:     now,
+		fractions: make(map[string]float64),
+		lastTime:  now,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	sampledAll := true
+	for _, t := range targets {
+		p.fractions[t.bucket+"/"+t.prefix] = 0
+		p.total += int64(t.sample.Count)
+		sampledAll = sampledAll && !t.sample.Truncated
+	}
+	if !sampledAll {
+		p.total = 0
+	}
+	return p
+}
+
+func (p *progress) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fmt.Fprint(p.term, clearLine)
+	n, err := p.logs.Write(b)
+	fmt.Fprint(p.term, p.line)
+	return n, err
+}
+
+// onEvent counts the versions listed and deleted, and tracks how much of
+// each target has been listed.
+func (p *progress) onEvent(e s3util.Event) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch e.Kind {
+	case s3util.EventPageListed:
+		p.listed += int64(e.Count)
+		p.selected += int64(e.Selected)
+		p.fractions[e.Bucket+"/"+e.Prefix] = e.Fraction
+	case s3util.EventRangeListed:
+		p.fractions[e.Bucket+"/"+e.Prefix] = e.Fraction
+	case s3util.EventBatchDeleted:
+		p.deleted += int64(e.Count)
+		p.bytes += e.Bytes
+	}
+}
+
+// run redraws the status line every period until stopped.
+func (p *progress) run(period time.Duration) {
+	defer close(p.done)
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			p.refresh(now)
+		case <-p.stop:
+			p.refresh(time.Now())
+			p.mu.Lock()
+			fmt.Fprintln(p.term)
+			p.line = ""
+			p.mu.Unlock()
+			return
+		}
+	}
+}
+
+// finish draws the final status line and leaves it in place.  The progress
+// must not be written to afterwards.
+func (p *progress) finish() {
+	close(p.stop)
+	<-p.done
+}
+
+func (p *progress) refresh(now time.Time) {
+	retries := metrics.GetOrRegisterCounter("retries_total", nil).Count()
+	workers := metrics.GetOrRegisterGauge("concurrency_in_flight", nil).Value()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	elapsed := now.Sub(p.lastTime).Seconds()
+	var deleteRate, retryRate float64
+	if elapsed > 0 {
+		deleteRate = float64(p.deleted-p.lastDeleted) / elapsed
+		retryRate = float64(retries-p.lastRetries) / elapsed
+	}
+	p.lastTime, p.lastDeleted, p.lastRetries = now, p.deleted, retries
+
+	eta := "?"
+	if d, ok := p.eta(now, deleteRate); ok {
+		eta = "~" + d.Round(time.Second).String()
+	}
+	p.line = fmt.Sprintf("listed %d  deleted %d (%.0f/s)  freed %s  workers %d  retries %.1f/s  eta %s",
+		p.listed, p.deleted, deleteRate, formatBytes(p.bytes), workers, retryRate, eta)
+	fmt.Fprint(p.term, clearLine+p.line)
+}
+
+// eta estimates the time left, or returns false until there is an estimate.
+// While listing, the time taken so far is extrapolated to the rest of the
+// targets, which is measured by the count of versions the plan sampled if
+// it saw them all, and otherwise by how far into its key space each target
+// has been listed.  Once everything has been listed, the versions still to be
+// deleted are divided by the delete rate.
+func (p *progress) eta(now time.Time, deleteRate float64) (time.Duration, bool) {
+	listed := 0.0
+	if p.total > 0 {
+		listed = float64(p.listed) / float64(p.total)
+	} else if len(p.fractions) > 0 {
+		for _, f := range p.fractions {
+			listed += f
+		}
+		listed /= float64(len(p.fractions))
+	}
+
+	switch {
+	case listed <= 0:
+		return 0, false
+	case listed < 1:
+		return time.Duration(float64(now.Sub(p.start)) * (1 - listed) / listed), true
+	case p.deleted >= p.selected:
+		return 0, true
+	case deleteRate > 0:
+		return time.Duration(float64(p.selected-p.deleted) / deleteRate * float64(time.Second)), true
+	}
+	return 0, false
+}
+
+// formatBytes formats n in binary units, e.g. 1.5GiB.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,199 @@
+// Copyright 2018 Sergey Grankin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s3util
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuditRecord is the outcome of deleting a single version, as reported in a
+// DeleteObjects response: either it was deleted, or Code and Message say why
+// not.
+type AuditRecord struct {
+	Bucket       string    `json:"bucket"`
+	Key          string    `json:"key"`
+	VersionId    string    `json:"version_id"`
+	DeleteMarker bool      `json:"delete_marker"`
+	Size         int64     `json:"size"`
+	LastModified time.Time `json:"last_modified"`
+	DeletedAt    time.Time `json:"deleted_at"` // when the response was received
+	RequestId    string    `json:"request_id"`
+	Failed       bool      `json:"failed,omitempty"`
+	Code         string    `json:"code,omitempty"`
+	Message      string    `json:"message,omitempty"`
+}
+
+// AuditLogOptions configure an AuditLog.
+type AuditLogOptions struct {
+	Gzip    bool  // compress the log; appended sessions are concatenated gzip members
+	MaxSize int64 // rotate the log once it is this large on disk, if set
+}
+
+// AuditLog appends AuditRecords to a file as JSON Lines.  Each batch of
+// records is flushed to the file as it is written, so that no more than the
+// batch in progress can be lost.
+type AuditLog struct {
+	path string
+	opts AuditLogOptions
+
+	mu   sync.Mutex
+	file *os.File
+	size int64 // of file, as written so far
+	gz   *gzip.Writer
+	buf  *bufio.Writer
+
+	closed bool
+}
+
+// OpenAuditLog opens the audit log at path for appending, creating it if it
+// does not exist.
+func OpenAuditLog(path string, opts AuditLogOptions) (*AuditLog, error) {
+	l := &AuditLog{path: path, opts: opts}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *AuditLog) open() error {
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	l.file, l.size = file, fi.Size()
+
+	var w io.Writer = &countingWriter{w: file, n: &l.size}
+	if l.opts.Gzip {
+		l.gz = gzip.NewWriter(w)
+		w = l.gz
+	}
+	l.buf = bufio.NewWriter(w)
+	return nil
+}
+
+// countingWriter adds the number of bytes written to w to n.
+type countingWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	*cw.n += int64(n)
+	return n, err
+}
+
+// Record appends records to the log and flushes them to the file, rotating
+// it first if it has reached the maximum size.
+func (l *AuditLog) Record(records []AuditRecord) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return errAuditLogClosed
+	}
+	if l.opts.MaxSize > 0 && l.size >= l.opts.MaxSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+	enc := json.NewEncoder(l.buf)
+	for i := range records {
+		if err := enc.Encode(&records[i]); err != nil {
+			return err
+		}
+	}
+	if err := l.buf.Flush(); err != nil {
+		return err
+	}
+	if l.gz != nil {
+		return l.gz.Flush()
+	}
+	return nil
+}
+
+// rotate closes the log and renames it aside, with the time inserted before
+// its extension, e.g. audit-20180102T150405.000Z.jsonl.gz, and starts a new
+// one.  A number is appended to the time if the name is taken.
+func (l *AuditLog) rotate() error {
+	if err := l.close(); err != nil {
+		return err
+	}
+	dir, name := filepath.Split(l.path)
+	ext := ""
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		name, ext = name[:i], name[i:]
+	}
+	stamp := time.Now().UTC().Format("20060102T150405.000Z")
+	rotated := filepath.Join(dir, name+"-"+stamp+ext)
+	for i := 1; fileExists(rotated); i++ {
+		rotated = filepath.Join(dir, fmt.Sprintf("%s-%s-%d%s", name, stamp, i, ext))
+	}
+	if err := os.Rename(l.path, rotated); err != nil {
+		return err
+	}
+	return l.open()
+}
+
+func fileExists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+var errAuditLogClosed = errors.New("audit log closed")
+
+// Close flushes the log and closes the file.  Records written after Close
+// fail, and closing again does nothing, so an exiting process may close the
+// log while deletes are still in flight.
+func (l *AuditLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	return l.close()
+}
+
+func (l *AuditLog) close() error {
+	err := l.buf.Flush()
+	if l.gz != nil {
+		if gzErr := l.gz.Close(); err == nil {
+			err = gzErr
+		}
+	}
+	if syncErr := l.file.Sync(); err == nil {
+		err = syncErr
+	}
+	if closeErr := l.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,101 @@
+// Copyright 2018 Sergey Grankin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s3util
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// readAuditLogs returns the records in every audit log in dir.
+func readAuditLogs(t *testing.T, dir string, gzipped bool) (records []AuditRecord, files int) {
+	names, err := filepath.Glob(filepath.Join(dir, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var r io.Reader = f
+		if gzipped {
+			if r, err = gzip.NewReader(f); err != nil {
+				t.Fatal(err)
+			}
+		}
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			var rec AuditRecord
+			if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			records = append(records, rec)
+		}
+		if err := scanner.Err(); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		f.Close()
+	}
+	return records, len(names)
+}
+
+func TestAuditLog(t *testing.T) {
+	for _, gzipped := range []bool{false, true} {
+		dir, err := ioutil.TempDir("", "audit")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "audit.jsonl")
+
+		// Append across sessions, rotating after every batch.
+		for session := 0; session < 2; session++ {
+			log, err := OpenAuditLog(path, AuditLogOptions{Gzip: gzipped, MaxSize: 1})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for batch := 0; batch < 2; batch++ {
+				if err := log.Record([]AuditRecord{{Bucket: "b", Key: "k1"}, {Bucket: "b", Key: "k2"}}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := log.Close(); err != nil {
+				t.Fatal(err)
+			}
+			// As when a signal closes the log under a deleter.
+			if err := log.Close(); err != nil {
+				t.Errorf("closing again: %v", err)
+			}
+			if err := log.Record([]AuditRecord{{Bucket: "b", Key: "late"}}); err == nil {
+				t.Error("recorded to a closed log")
+			}
+		}
+
+		records, files := readAuditLogs(t, dir, gzipped)
+		if len(records) != 8 {
+			t.Errorf("gzip %v: read %d records, want 8", gzipped, len(records))
+		}
+		if files < 2 {
+			t.Errorf("gzip %v: found %d files, want rotated ones", gzipped, files)
+		}
+	}
+}
@@ -0,0 +1,362 @@
+// Copyright 2018 Sergey Grankin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s3util
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ListerState is the persisted progress of listing one key range of a
+// bucket/prefix: keys after the markers up to and including EndKey (or to the
+// end of the prefix, if empty).  The markers only cover pages whose objects
+// have all been deleted, so resuming from them never skips anything (but may
+// repeat deletes of the following pages).
+type ListerState struct {
+	Bucket          string `json:"bucket"`
+	Prefix          string `json:"prefix"`
+	KeyMarker       string `json:"key_marker,omitempty"`
+	VersionIdMarker string `json:"version_id_marker,omitempty"`
+	EndKey          string `json:"end_key,omitempty"`
+	Listed          int64  `json:"listed"`
+	Deleted         int64  `json:"deleted"`
+	Done            bool   `json:"done,omitempty"`
+}
+
+// Checkpoint is the saved progress of a purge, which a later purge of the
+// same targets can resume from.
+type Checkpoint struct {
+	Listers []ListerState `json:"listers"`
+}
+
+// tracker tracks the progress of every lister in a purge.
+type tracker struct {
+	mu      sync.Mutex
+	listers []*listerProgress
+
+	// onSplittable, if set, is called whenever a range becomes splittable.
+	onSplittable func()
+}
+
+// listerProgress tracks pages handed to deleters by one lister, in listing
+// order, and advances the lister's markers as the oldest pages are acked.
+type listerProgress struct {
+	mu      sync.Mutex
+	state   ListerState
+	pos     string // last key listed, which may be ahead of the markers
+	pending []*pageProgress
+
+	// origin is where the range's keys start, for estimating how much of it
+	// has been listed: its start marker, or the first key listed in it if it
+	// starts at the beginning of the prefix.
+	origin    string
+	listedAll bool // the last page of the range has been listed
+
+	// splittable is set once a page short of the end has been listed since
+	// the range was created or last split.  Ranges are only split when they
+	// have shown there is more to list; otherwise idle listers would keep
+	// splitting off empty ranges at the end of the key space.
+	splittable   bool
+	onSplittable func() // the tracker's, called without holding mu
+}
+
+type pageProgress struct {
+	lister   *listerProgress
+	next     Marker
+	last     bool
+	selected int64 // versions queued for deletion
+	acked    bool
+}
+
+func LoadCheckpoint(path string) (*Checkpoint, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cp Checkpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return nil, err
+	}
+	return &cp, nil
+}
+
+// resume registers the key ranges of bucket/prefix saved in resumed, and
+// returns those not yet done.  ok is false if there were none saved.
+func (c *tracker) resume(bucket, prefix string, resumed *Checkpoint) (todo []*listerProgress, ok bool) {
+	if resumed == nil {
+		return nil, false
+	}
+	for _, st := range resumed.Listers {
+		if st.Bucket == bucket && st.Prefix == prefix {
+			ok = true
+			if lp := c.add(st); !st.Done {
+				todo = append(todo, lp)
+			}
+		}
+	}
+	return todo, ok
+}
+
+// add registers a lister for the key range in st.
+func (c *tracker) add(st ListerState) *listerProgress {
+	lp := &listerProgress{state: st, pos: st.KeyMarker, origin: st.KeyMarker, listedAll: st.Done, onSplittable: c.onSplittable}
+
+	c.mu.Lock()
+	c.listers = append(c.listers, lp)
+	c.mu.Unlock()
+	return lp
+}
+
+// split cuts the unlisted part of lp's range roughly in half, and registers
+// and returns a lister for the upper half, or returns nil if the range is too
+// narrow.  It holds both locks so that a concurrent snapshot sees either both
+// halves or neither.
+func (c *tracker) split(lp *listerProgress) *listerProgress {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+
+	if lp.state.Done || !lp.splittable {
+		return nil
+	}
+	lo := lp.pos
+	if lo < lp.state.Prefix {
+		lo = lp.state.Prefix
+	}
+	hi := lp.state.EndKey
+	if hi == "" {
+		hi = PrefixEnd(lp.state.Prefix)
+	}
+	mid, ok := MidKey(lo, hi)
+	if !ok {
+		return nil
+	}
+
+	upper := &listerProgress{
+		state: ListerState{
+			Bucket:    lp.state.Bucket,
+			Prefix:    lp.state.Prefix,
+			KeyMarker: mid,
+			EndKey:    lp.state.EndKey,
+		},
+		pos:          mid,
+		origin:       mid,
+		onSplittable: c.onSplittable,
+	}
+	lp.state.EndKey = mid
+	lp.splittable = false
+	c.listers = append(c.listers, upper)
+	return upper
+}
+
+func (lp *listerProgress) start() Marker {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+	return Marker{
+		KeyMarker:       lp.state.KeyMarker,
+		VersionIdMarker: lp.state.VersionIdMarker,
+	}
+}
+
+// end returns the last key in lp's range, or "" if it is unbounded.  It
+// shrinks when the range is split.
+func (lp *listerProgress) end() string {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+	return lp.state.EndKey
+}
+
+// span estimates the fraction of its prefix's key space that lp has yet to
+// list.
+func (lp *listerProgress) span() float64 {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+	hi := 1.0
+	if lp.state.EndKey != "" {
+		hi = KeyPoint(lp.state.Prefix, lp.state.EndKey)
+	}
+	return hi - KeyPoint(lp.state.Prefix, lp.pos)
+}
+
+// listedFraction estimates how much of the key space under bucket/prefix has
+// been listed, from how far each of its ranges has got.  Keys are placed with
+// KeyPoint and unbounded ranges taken to end at the last printable ASCII key,
+// so the estimate is rough where keys are spread unevenly; it is 0 until
+// something has been listed.
+func (c *tracker) listedFraction(bucket, prefix string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var listed, width float64
+	for _, lp := range c.listers {
+		if lp.state.Bucket != bucket || lp.state.Prefix != prefix {
+			continue
+		}
+		l, w := lp.extent()
+		listed += l
+		width += w
+	}
+	if width <= 0 {
+		return 0
+	}
+	return listed / width
+}
+
+// extent returns how much of lp's range, as placed by KeyPoint, has been
+// listed, and how wide the range is.
+func (lp *listerProgress) extent() (listed, width float64) {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+	prefix := lp.state.Prefix
+	lo := KeyPoint(prefix, lp.origin)
+	hi := KeyPoint(prefix, prefix+string(rune(maxSplitChar+1)))
+	if lp.state.EndKey != "" {
+		hi = KeyPoint(prefix, lp.state.EndKey)
+	}
+	width = hi - lo
+	if width < 0 {
+		width = 0
+	}
+	if lp.listedAll {
+		return width, width
+	}
+	listed = KeyPoint(prefix, lp.pos) - lo
+	if listed < 0 {
+		listed = 0
+	} else if listed > width {
+		listed = width
+	}
+	return listed, width
+}
+
+// claim cuts page at the end of lp's range, marking it the last page if
+// anything was cut, and advances lp's position past it.  Both happen under
+// one lock, so that a concurrent split can't move the end below keys of the
+// page, which the new upper range would then list again.
+func (lp *listerProgress) claim(page *Page) *Page {
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+	if end := lp.state.EndKey; end != "" {
+		n := sort.Search(len(page.Versions), func(i int) bool {
+			return page.Versions[i].Key > end
+		})
+		if n < len(page.Versions) {
+			page = &Page{Versions: page.Versions[:n], Next: page.Next, Last: true}
+		}
+	}
+	if n := len(page.Versions); n > 0 && page.Versions[n-1].Key > lp.pos {
+		lp.pos = page.Versions[n-1].Key
+	}
+	if lp.origin == "" && len(page.Versions) > 0 {
+		lp.origin = page.Versions[0].Key
+	}
+	if page.Last {
+		lp.listedAll = true
+	}
+	return page
+}
+
+// addPage records a listed page of which selected versions were queued for
+// deletion; the returned pageProgress must be acked once they are deleted.
+func (lp *listerProgress) addPage(page *Page, selected int) *pageProgress {
+	p := &pageProgress{
+		lister:   lp,
+		next:     page.Next,
+		last:     page.Last,
+		selected: int64(selected),
+	}
+
+	lp.mu.Lock()
+	lp.state.Listed += int64(len(page.Versions))
+	lp.pending = append(lp.pending, p)
+	woke := !page.Last && !lp.splittable
+	if !page.Last {
+		lp.splittable = true
+	}
+	lp.mu.Unlock()
+
+	// Idle listers wait for a range to split; let them know there is one.
+	if woke && lp.onSplittable != nil {
+		lp.onSplittable()
+	}
+	return p
+}
+
+func (p *pageProgress) ack() {
+	lp := p.lister
+	lp.mu.Lock()
+	defer lp.mu.Unlock()
+
+	p.acked = true
+	for len(lp.pending) > 0 && lp.pending[0].acked {
+		head := lp.pending[0]
+		lp.pending = lp.pending[1:]
+		lp.state.KeyMarker = head.next.KeyMarker
+		lp.state.VersionIdMarker = head.next.VersionIdMarker
+		lp.state.Deleted += head.selected
+		lp.state.Done = head.last
+	}
+}
+
+func (c *tracker) snapshot() *Checkpoint {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cp := &Checkpoint{Listers: make([]ListerState, 0, len(c.listers))}
+	for _, lp := range c.listers {
+		lp.mu.Lock()
+		cp.Listers = append(cp.Listers, lp.state)
+		lp.mu.Unlock()
+	}
+	return cp
+}
+
+// save atomically replaces the file at path with the current progress.
+func (c *tracker) save(path string) error {
+	return c.snapshot().Save(path)
+}
+
+// Save atomically replaces the file at path with cp.
+func (cp *Checkpoint) Save(path string) error {
+	data, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// saveEvery saves the checkpoint to path every period until stop is closed.
+func (c *tracker) saveEvery(path string, period time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.save(path); err != nil {
+				LogError("checkpoint_failed", Fields{"path": path, "error": err}, "saving checkpoint: %v", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
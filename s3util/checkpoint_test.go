@@ -0,0 +1,226 @@
+// Copyright 2018 Sergey Grankin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s3util
+
+import (
+	"context"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestCheckpointRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "checkpoint.json")
+
+	cp := &Checkpoint{Listers: []ListerState{
+		{Bucket: "b", Prefix: "p/", KeyMarker: "p/k", VersionIdMarker: "v", EndKey: "p/m", Listed: 10, Deleted: 8},
+		{Bucket: "b", Prefix: "p/", KeyMarker: "p/m", Done: true},
+	}}
+	if err := cp.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	got, err := LoadCheckpoint(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, cp) {
+		t.Errorf("loaded %+v, want %+v", got, cp)
+	}
+}
+
+func TestAckOrder(t *testing.T) {
+	var c tracker
+	lp := c.add(ListerState{Bucket: "b"})
+	page := func(key string, last bool) *Page {
+		return &Page{
+			Versions: []Version{{Key: key, VersionId: "1"}},
+			Next:     Marker{KeyMarker: key, VersionIdMarker: "1"},
+			Last:     last,
+		}
+	}
+	p1 := lp.addPage(page("a", false), 1)
+	p2 := lp.addPage(page("b", false), 1)
+	p3 := lp.addPage(page("c", true), 1)
+
+	// Acking later pages first must not advance past the unacked first one.
+	p3.ack()
+	p2.ack()
+	if st := c.snapshot().Listers[0]; st.KeyMarker != "" || st.Deleted != 0 || st.Done {
+		t.Fatalf("advanced to %+v before the first page was acked", st)
+	}
+	p1.ack()
+	want := ListerState{Bucket: "b", KeyMarker: "c", VersionIdMarker: "1", Listed: 3, Deleted: 3, Done: true}
+	if st := c.snapshot().Listers[0]; st != want {
+		t.Errorf("advanced to %+v, want %+v", st, want)
+	}
+}
+
+func TestTrackerResume(t *testing.T) {
+	resumed := &Checkpoint{Listers: []ListerState{
+		{Bucket: "b", Prefix: "p/", EndKey: "p/m", Done: true},
+		{Bucket: "b", Prefix: "p/", KeyMarker: "p/m"},
+		{Bucket: "b", Prefix: "q/"},
+	}}
+	var c tracker
+	todo, ok := c.resume("b", "p/", resumed)
+	if !ok || len(todo) != 1 || todo[0].state != resumed.Listers[1] {
+		t.Errorf("resumed %d ranges (saved: %v), want the one not done", len(todo), ok)
+	}
+	if n := len(c.snapshot().Listers); n != 2 {
+		t.Errorf("tracked %d ranges, want both of p/ so that they are saved again", n)
+	}
+	if _, ok := c.resume("b", "r/", resumed); ok {
+		t.Error("resumed a prefix that was not saved")
+	}
+	if _, ok := c.resume("b", "p/", nil); ok {
+		t.Error("resumed without a checkpoint")
+	}
+}
+
+func TestListedFraction(t *testing.T) {
+	var c tracker
+	lp := c.add(ListerState{Bucket: "b", Prefix: "p/"})
+	if f := c.listedFraction("b", "p/"); f != 0 {
+		t.Errorf("listed %g before listing, want 0", f)
+	}
+
+	// The range starts at its first key, p/A, and ends at p/\x7f.
+	page := &Page{Versions: []Version{{Key: "p/A"}, {Key: "p/`"}}, Next: Marker{KeyMarker: "p/`"}}
+	lp.addPage(lp.claim(page), 0)
+	check := func(want float64) {
+		t.Helper()
+		if f := c.listedFraction("b", "p/"); math.Abs(f-want) > 1e-9 {
+			t.Errorf("listed %g, want %g", f, want)
+		}
+	}
+	check(float64('`'-'A') / float64(0x7f-'A'))
+
+	// Splitting at p/p leaves the estimate alone, and the lower range
+	// counts in full once listed.
+	upper := c.split(lp)
+	if upper == nil || upper.state.KeyMarker != "p/p" {
+		t.Fatalf("split off %+v, want a range from p/p", upper)
+	}
+	check(float64('`'-'A') / float64(0x7f-'A'))
+	lp.addPage(lp.claim(&Page{Last: true}), 0)
+	check(float64('p'-'A') / float64(0x7f-'A'))
+	upper.addPage(upper.claim(&Page{Versions: []Version{{Key: "p/z"}}, Last: true}), 0)
+	check(1)
+
+	if f := c.listedFraction("b", "q/"); f != 0 {
+		t.Errorf("listed %g of another prefix, want 0", f)
+	}
+}
+
+func TestClaimAndSplit(t *testing.T) {
+	var c tracker
+	lp := c.add(ListerState{Bucket: "b"})
+	keys := func(keys ...string) *Page {
+		page := &Page{Next: Marker{KeyMarker: keys[len(keys)-1]}}
+		for _, k := range keys {
+			page.Versions = append(page.Versions, Version{Key: k})
+		}
+		return page
+	}
+	lp.addPage(lp.claim(keys("a", "b")), 0)
+
+	// A split while a claimed page is being filtered must not cut the
+	// range below it.
+	page := lp.claim(keys("c", "m"))
+	upper := c.split(lp)
+	if upper == nil || upper.state.KeyMarker <= "m" {
+		t.Fatalf("split off %+v, want a range above the claimed page", upper)
+	}
+	lp.addPage(page, 0)
+	if page.Last {
+		t.Error("claimed page was cut by the split")
+	}
+
+	// The next page is cut at the new end.
+	mid := upper.state.KeyMarker
+	page = lp.claim(keys("n", mid, mid+"a"))
+	if !page.Last || len(page.Versions) != 2 {
+		t.Errorf("claimed %+v, want n and %q as the last page", page.Versions, mid)
+	}
+}
+
+func TestPurgeResume(t *testing.T) {
+	srv, opts := newPurgeFake(t, "bucket")
+	defer srv.Close()
+	dir, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	opts.Checkpoint = filepath.Join(dir, "checkpoint.json")
+	all := srv.Versions("bucket")
+
+	// Stop after the first deleted batch.
+	ctx, cancel := context.WithCancel(context.Background())
+	var once sync.Once
+	opts.OnEvent = func(e Event) {
+		if e.Kind == EventBatchDeleted {
+			once.Do(cancel)
+		}
+	}
+	result, err := NewPurger(opts).Purge(ctx, []Target{{Bucket: "bucket"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Completed {
+		t.Fatal("cancelled purge reported completion")
+	}
+	cp, err := LoadCheckpoint(opts.Checkpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every version left must still be ahead of the markers of a range that
+	// is not done, or resuming would skip it.
+	left := srv.Versions("bucket")
+	if len(left) == 0 || len(left) == len(all) {
+		t.Fatalf("%d of %d versions left, want the purge stopped midway", len(left), len(all))
+	}
+	for _, v := range left {
+		covered := false
+		for _, st := range cp.Listers {
+			if !st.Done && v.Key >= st.KeyMarker && (st.EndKey == "" || v.Key <= st.EndKey) {
+				covered = true
+			}
+		}
+		if !covered {
+			t.Errorf("%s (version %s) is left but behind every checkpointed range", v.Key, v.VersionId)
+		}
+	}
+
+	opts.OnEvent = nil
+	opts.Resume = cp
+	result, err = NewPurger(opts).Purge(context.Background(), []Target{{Bucket: "bucket"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Completed || srv.HasBucket("bucket") {
+		t.Errorf("resumed purge did not complete; %d versions left", len(srv.Versions("bucket")))
+	}
+}
@@ -15,8 +15,16 @@
 package s3util
 
 import (
-	"log"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/aws/external"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/rcrowley/go-metrics"
@@ -27,19 +35,220 @@ const (
 )
 
 var (
-	statClientRequests = metrics.NewRegisteredCounter("requests_total", nil)
+	statClientRequests  = metrics.NewRegisteredCounter("requests_total", nil)
+	statRequestErrors   = metrics.NewRegisteredCounter("request_errors_total", nil)
+	statRequestDuration = metrics.NewRegisteredTimer("request_duration_seconds", nil)
 )
 
+// S3 is a client for buckets in any region.  The embedded client is for the
+// default region; requests for a bucket located with BucketRegion are sent
+// through a client for the bucket's own region.
 type S3 struct {
 	*s3.S3
+
+	Retry  RetryPolicy
+	Limits *RateLimits // nil for unlimited
+
+	// OnThrottle, if set, is called whenever a request or key is throttled.
+	OnThrottle func()
+
+	// OnDeleteRoundTrip, if set, is called with the latency of every
+	// DeleteObjects and AbortMultipartUpload request sent, excluding rate
+	// limiting and retry backoff.
+	OnDeleteRoundTrip func(latency time.Duration)
+
+	// Audit, if set, is called with the outcome of every version in each
+	// DeleteObjects response.  If it fails, the delete fails with an
+	// *AuditError.
+	Audit func(records []AuditRecord) error
+
+	cfg      aws.Config
+	endpoint Endpoint
+	mu       sync.Mutex
+	regions  map[string]*s3.S3 // by region
+	buckets  map[string]*s3.S3 // by bucket
 }
 
-func MustNewClient(region string) *S3 {
+// observeRequest records a request for the S3 operation op, sent at start,
+// that failed with err if not nil.
+func observeRequest(op string, start time.Time, err error) {
+	statClientRequests.Inc(1)
+	labeledCounter("requests_total", "op", op).Inc(1)
+	statRequestDuration.UpdateSince(start)
+	metrics.GetOrRegisterTimer(labeledName("request_duration_seconds", "op", op), nil).UpdateSince(start)
+	if err != nil {
+		statRequestErrors.Inc(1)
+		code := errorCode(err)
+		if code == "" {
+			code = "Unknown"
+		}
+		labeledCounter("request_errors_total", "op", op, "code", code).Inc(1)
+	}
+}
+
+// noteDeleteRoundTrip passes the latency of a delete request sent at start on
+// to the client's OnDeleteRoundTrip hook.
+func (client *S3) noteDeleteRoundTrip(start time.Time) {
+	if client.OnDeleteRoundTrip != nil {
+		client.OnDeleteRoundTrip(time.Since(start))
+	}
+}
+
+// Endpoint configures the client for an S3-compatible store such as MinIO or
+// Ceph RGW.  The zero Endpoint is AWS.
+type Endpoint struct {
+	URL                string // e.g. http://localhost:9000; empty for AWS
+	PathStyle          bool   // address buckets as URL paths, not host names
+	InsecureSkipVerify bool   // don't verify the server's TLS certificate
+	CABundle           string // PEM file of CA certificates to trust
+}
+
+func NewClient(region string, endpoint Endpoint) (*S3, error) {
 	cfg, err := external.LoadDefaultAWSConfig()
 	if err != nil {
-		log.Fatalf("error: unable to configure AWS SDK: %v", err)
+		return nil, fmt.Errorf("unable to configure AWS SDK: %v", err)
 	}
 	cfg.Region = region
+	cfg.Retryer = aws.DefaultRetryer{NumMaxRetries: 0} // retries are governed by RetryPolicy
+	if endpoint.URL != "" {
+		cfg.EndpointResolver = aws.ResolveWithEndpointURL(endpoint.URL)
+	}
+	if endpoint.InsecureSkipVerify || endpoint.CABundle != "" {
+		tlsConfig := &tls.Config{InsecureSkipVerify: endpoint.InsecureSkipVerify}
+		if endpoint.CABundle != "" {
+			pem, err := ioutil.ReadFile(endpoint.CABundle)
+			if err != nil {
+				return nil, fmt.Errorf("reading CA bundle: %v", err)
+			}
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in CA bundle %s", endpoint.CABundle)
+			}
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tlsConfig
+		cfg.HTTPClient = &http.Client{Transport: transport}
+	}
+
+	client := &S3{
+		Retry:    DefaultRetryPolicy,
+		cfg:      cfg,
+		endpoint: endpoint,
+		regions:  make(map[string]*s3.S3),
+		buckets:  make(map[string]*s3.S3),
+	}
+	client.S3 = client.newAPI(cfg)
+	return client, nil
+}
+
+func MustNewClient(region string, endpoint Endpoint) *S3 {
+	client, err := NewClient(region, endpoint)
+	if err != nil {
+		LogFatal("client_failed", Fields{"region": region, "error": err}, "%v", err)
+	}
+	return client
+}
+
+func (client *S3) newAPI(cfg aws.Config) *s3.S3 {
+	api := s3.New(cfg)
+	api.ForcePathStyle = client.endpoint.PathStyle
+	return api
+}
+
+// forBucket returns the client for the bucket's region, or the default client
+// if the bucket has not been located.
+func (client *S3) forBucket(bucket string) *s3.S3 {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if api := client.buckets[bucket]; api != nil {
+		return api
+	}
+	return client.S3
+}
+
+// setRegion routes further requests for bucket to region, creating a client
+// for the region if there is none yet.  A custom endpoint serves all buckets,
+// so they keep using the default client.
+func (client *S3) setRegion(bucket, region string) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if region == client.cfg.Region || client.endpoint.URL != "" {
+		client.buckets[bucket] = client.S3
+		return
+	}
+	api := client.regions[region]
+	if api == nil {
+		cfg := client.cfg.Copy()
+		cfg.Region = region
+		api = client.newAPI(cfg)
+		client.regions[region] = api
+	}
+	client.buckets[bucket] = api
+}
 
-	return &S3{s3.New(cfg)}
+// BucketRegion returns the region the bucket was created in, and sends
+// further requests for the bucket to that region.  If GetBucketLocation is
+// denied, the region is taken from the x-amz-bucket-region header of a
+// HeadBucket response instead, which S3 sets even on a redirect.  Both are
+// retried according to the client's retry policy.
+func (client *S3) BucketRegion(ctx context.Context, bucket string) (string, error) {
+	region, err := client.getBucketLocation(ctx, bucket)
+	if err == nil {
+		client.setRegion(bucket, region)
+		return region, nil
+	}
+
+	region, headErr := client.headBucketRegion(ctx, bucket)
+	if region != "" {
+		client.setRegion(bucket, region)
+		return region, nil
+	}
+	if headErr != nil && errorCode(err) == "AccessDenied" {
+		err = headErr
+	}
+	return "", &BucketError{Bucket: bucket, Op: "GetBucketLocation", Err: err}
+}
+
+func (client *S3) getBucketLocation(ctx context.Context, bucket string) (string, error) {
+	for attempt := 1; ; attempt++ {
+		req := client.GetBucketLocationRequest(&s3.GetBucketLocationInput{
+			Bucket: &bucket,
+		})
+		req.SetContext(ctx)
+		req.ApplyOptions(s3.WithNormalizeBucketLocation)
+		start := time.Now()
+		out, err := req.Send()
+		observeRequest("GetBucketLocation", start, err)
+		if err == nil {
+			return string(out.LocationConstraint), nil
+		}
+		client.noteThrottle(errorCode(err))
+		if !client.Retry.retryable(err) || !client.Retry.wait(ctx, attempt) {
+			return "", err
+		}
+	}
+}
+
+// headBucketRegion returns the x-amz-bucket-region header of a HeadBucket
+// response, or "" and the error if there is none.
+func (client *S3) headBucketRegion(ctx context.Context, bucket string) (string, error) {
+	for attempt := 1; ; attempt++ {
+		head := client.HeadBucketRequest(&s3.HeadBucketInput{Bucket: &bucket})
+		head.SetContext(ctx)
+		start := time.Now()
+		_, err := head.Send()
+		observeRequest("HeadBucket", start, err)
+		if resp := head.HTTPResponse; resp != nil {
+			if region := resp.Header.Get("X-Amz-Bucket-Region"); region != "" {
+				return region, nil
+			}
+		}
+		if err == nil {
+			return "", nil
+		}
+		client.noteThrottle(errorCode(err))
+		if !client.Retry.retryable(err) || !client.Retry.wait(ctx, attempt) {
+			return "", err
+		}
+	}
 }
@@ -0,0 +1,40 @@
+// Copyright 2018 Sergey Grankin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s3util
+
+import (
+	"context"
+	"testing"
+
+	"github.com/sgrankin/s3-purge-bucket/s3util/s3test"
+)
+
+func TestBucketRegionRetries(t *testing.T) {
+	client, srv := newTestClient(t)
+	defer srv.Close()
+	srv.CreateBucket("eu", "eu-west-1")
+	srv.Fail(s3test.OpGetBucketLocation, ErrCodeSlowDown, 2)
+
+	region, err := client.BucketRegion(context.Background(), "eu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if region != "eu-west-1" {
+		t.Errorf("region %q, want eu-west-1", region)
+	}
+	if n := srv.Requests(s3test.OpGetBucketLocation); n != 3 {
+		t.Errorf("sent %d requests, want 3", n)
+	}
+}
@@ -0,0 +1,176 @@
+// Copyright 2018 Sergey Grankin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s3util
+
+import (
+	"sync"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+var (
+	statConcurrencyLimit     = metrics.NewRegisteredGauge("concurrency_limit", nil)
+	statConcurrencyInFlight  = metrics.NewRegisteredGauge("concurrency_in_flight", nil)
+	statConcurrencyIncreases = metrics.NewRegisteredCounter("concurrency_increases_total", nil)
+	statConcurrencyDecreases = metrics.NewRegisteredCounter("concurrency_decreases_total", nil)
+)
+
+// Controller limits the number of requests in flight, adjusting the limit
+// with additive increase and multiplicative decrease.  Every Window, the limit
+// is halved if there was throttling or the mean latency exceeded twice its
+// baseline, and otherwise raised by Step if the limit was reached and
+// throughput held up.  The limit stays within [Min, Max].
+//
+// Latency is that of the round trips reported to Observe, rather than the
+// time between Acquire and Release, which includes client-side rate limiting
+// and retry backoff that say nothing about the service.
+type Controller struct {
+	Min, Max int
+	Step     int
+	Window   time.Duration
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	limit    int
+	inFlight int
+
+	windowStart time.Time
+	saturated   bool // the limit was reached during the window
+	throttled   bool
+	items       int64
+	requests    int64
+	latency     time.Duration
+	lastRate    float64
+	baseline    time.Duration
+}
+
+// NewController returns a Controller starting at initial requests in
+// flight.
+func NewController(initial, min, max int) *Controller {
+	if min < 1 {
+		min = 1
+	}
+	if max < min {
+		max = min
+	}
+	c := &Controller{
+		Min:         min,
+		Max:         max,
+		Step:        4,
+		Window:      time.Second,
+		limit:       clamp(initial, min, max),
+		windowStart: time.Now(),
+	}
+	c.cond = sync.NewCond(&c.mu)
+	statConcurrencyLimit.Update(int64(c.limit))
+	return c
+}
+
+// Acquire blocks until a request may be sent.  Each Acquire must be followed
+// by a Release.
+func (c *Controller) Acquire() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for c.inFlight >= c.limit {
+		c.saturated = true
+		c.cond.Wait()
+	}
+	c.inFlight++
+	if c.inFlight == c.limit {
+		c.saturated = true
+	}
+	statConcurrencyInFlight.Update(int64(c.inFlight))
+}
+
+// Release records a finished request that processed items.
+func (c *Controller) Release(items int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.inFlight--
+	c.items += int64(items)
+	statConcurrencyInFlight.Update(int64(c.inFlight))
+
+	if now := time.Now(); now.Sub(c.windowStart) >= c.Window {
+		c.adjust(now)
+	}
+	c.cond.Broadcast()
+}
+
+// Observe records the latency of a round trip to the service.
+func (c *Controller) Observe(latency time.Duration) {
+	c.mu.Lock()
+	c.requests++
+	c.latency += latency
+	c.mu.Unlock()
+}
+
+// Throttled records that the service asked to slow down.
+func (c *Controller) Throttled() {
+	c.mu.Lock()
+	c.throttled = true
+	c.mu.Unlock()
+}
+
+func (c *Controller) adjust(now time.Time) {
+	rate := float64(c.items) / now.Sub(c.windowStart).Seconds()
+	var mean time.Duration // zero, and never over the baseline, if nothing was observed
+	if c.requests > 0 {
+		mean = c.latency / time.Duration(c.requests)
+		if c.baseline == 0 || mean < c.baseline {
+			c.baseline = mean
+		} else {
+			c.baseline += (mean - c.baseline) / 100 // let the baseline drift up slowly
+		}
+	}
+
+	old := c.limit
+	reason := ""
+	switch {
+	case c.throttled:
+		c.limit = clamp(c.limit/2, c.Min, c.Max)
+		reason = "throttled"
+	case mean > 2*c.baseline:
+		c.limit = clamp(c.limit/2, c.Min, c.Max)
+		reason = "latency " + mean.String() + " over baseline " + c.baseline.String()
+	case c.saturated && rate >= 0.95*c.lastRate:
+		c.limit = clamp(c.limit+c.Step, c.Min, c.Max)
+		reason = "throughput holding"
+	}
+	if c.limit > old {
+		statConcurrencyIncreases.Inc(1)
+	} else if c.limit < old {
+		statConcurrencyDecreases.Inc(1)
+		LogDebug("concurrency_decreased", Fields{"from": old, "to": c.limit, "reason": reason},
+			"concurrency: %d -> %d: %s", old, c.limit, reason)
+	}
+	statConcurrencyLimit.Update(int64(c.limit))
+
+	c.windowStart = now
+	c.saturated = c.inFlight >= c.limit
+	c.throttled = false
+	c.items, c.requests, c.latency = 0, 0, 0
+	c.lastRate = rate
+}
+
+func clamp(n, min, max int) int {
+	if n < min {
+		return min
+	}
+	if n > max {
+		return max
+	}
+	return n
+}
@@ -0,0 +1,162 @@
+// Copyright 2018 Sergey Grankin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s3util
+
+import (
+	"testing"
+	"time"
+)
+
+// newTestController returns a Controller that only adjusts when told to.
+func newTestController(initial, min, max int) *Controller {
+	c := NewController(initial, min, max)
+	c.Window = time.Hour
+	return c
+}
+
+// runWindow runs requests on c, each deleting items in the given latency, and
+// then ends the window a second after it started.
+func runWindow(c *Controller, requests, items int, latency time.Duration, throttled bool) {
+	for i := 0; i < requests; i++ {
+		c.Acquire()
+	}
+	for i := 0; i < requests; i++ {
+		c.Observe(latency)
+		c.Release(items)
+	}
+	if throttled {
+		c.Throttled()
+	}
+	c.mu.Lock()
+	c.adjust(c.windowStart.Add(time.Second))
+	c.mu.Unlock()
+}
+
+func TestControllerIncrease(t *testing.T) {
+	c := newTestController(8, 2, 20)
+	for _, want := range []int{12, 16, 20, 20} {
+		runWindow(c, c.limit, 1000, 10*time.Millisecond, false)
+		if c.limit != want {
+			t.Fatalf("limit %d, want %d", c.limit, want)
+		}
+	}
+
+	// Throughput that falls off doesn't earn an increase.
+	c = newTestController(8, 2, 20)
+	runWindow(c, 8, 1000, 10*time.Millisecond, false)
+	runWindow(c, 12, 100, 10*time.Millisecond, false)
+	if c.limit != 12 {
+		t.Errorf("limit %d after throughput fell, want 12", c.limit)
+	}
+
+	// Nor does a window that never reached the limit.
+	c = newTestController(8, 2, 20)
+	runWindow(c, 4, 1000, 10*time.Millisecond, false)
+	if c.limit != 8 {
+		t.Errorf("limit %d after an unsaturated window, want 8", c.limit)
+	}
+}
+
+func TestControllerThrottled(t *testing.T) {
+	c := newTestController(16, 3, 32)
+	for _, want := range []int{8, 4, 3, 3} {
+		runWindow(c, c.limit, 1000, 10*time.Millisecond, true)
+		if c.limit != want {
+			t.Fatalf("limit %d, want %d", c.limit, want)
+		}
+	}
+}
+
+func TestControllerLatency(t *testing.T) {
+	c := newTestController(16, 2, 32)
+	runWindow(c, 16, 1000, 10*time.Millisecond, false)
+	if c.limit != 20 {
+		t.Fatalf("limit %d, want 20", c.limit)
+	}
+	runWindow(c, 20, 1000, 15*time.Millisecond, false) // under twice the baseline
+	if c.limit != 24 {
+		t.Fatalf("limit %d after a mild slowdown, want 24", c.limit)
+	}
+	runWindow(c, 24, 1000, 30*time.Millisecond, false)
+	if c.limit != 12 {
+		t.Fatalf("limit %d after a latency spike, want 12", c.limit)
+	}
+
+	// Without any round trips observed, there is no latency to judge.
+	runWindow(c, 0, 0, 0, false)
+	if c.limit != 12 {
+		t.Errorf("limit %d after an idle window, want 12", c.limit)
+	}
+}
+
+func TestControllerClamp(t *testing.T) {
+	c := NewController(100, 0, 10)
+	if c.limit != 10 || c.Min != 1 {
+		t.Errorf("limit %d within [%d, %d], want 10 within [1, 10]", c.limit, c.Min, c.Max)
+	}
+	c = NewController(1, 5, 2)
+	if c.limit != 5 || c.Max != 5 {
+		t.Errorf("limit %d within [%d, %d], want 5 within [5, 5]", c.limit, c.Min, c.Max)
+	}
+}
+
+func TestControllerShrinkInFlight(t *testing.T) {
+	c := newTestController(8, 1, 8)
+	for i := 0; i < 8; i++ {
+		c.Acquire()
+	}
+	c.Throttled()
+	c.mu.Lock()
+	c.adjust(c.windowStart.Add(time.Second))
+	c.mu.Unlock()
+	if c.limit != 4 {
+		t.Fatalf("limit %d, want 4", c.limit)
+	}
+
+	// With 8 in flight and a limit of 4, another request waits for 5 to
+	// finish.
+	acquired := make(chan struct{})
+	go func() {
+		c.Acquire()
+		close(acquired)
+	}()
+	for i := 0; i < 4; i++ {
+		c.Release(1)
+	}
+	select {
+	case <-acquired:
+		t.Fatal("acquired with 4 in flight and a limit of 4")
+	case <-time.After(20 * time.Millisecond):
+	}
+	c.Release(1)
+	select {
+	case <-acquired:
+	case <-time.After(5 * time.Second):
+		t.Fatal("not acquired with 3 in flight and a limit of 4")
+	}
+
+	c.mu.Lock()
+	inFlight := c.inFlight
+	c.mu.Unlock()
+	if inFlight != 4 {
+		t.Errorf("%d in flight, want 4", inFlight)
+	}
+	for i := 0; i < 4; i++ {
+		c.Release(1)
+	}
+	if c.inFlight != 0 {
+		t.Errorf("%d in flight after releasing everything, want 0", c.inFlight)
+	}
+}
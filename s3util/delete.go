@@ -15,75 +15,167 @@
 package s3util
 
 import (
-	"log"
+	"context"
+	"time"
 
-	"github.com/aws/aws-sdk-go-v2/aws/awserr"
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/rcrowley/go-metrics"
 )
 
 var (
 	statDeletesPending = metrics.NewRegisteredCounter("deletes_pending", nil)
+	statDeleteBatch    = metrics.NewRegisteredHistogram("delete_batch_size", nil, metrics.NewExpDecaySample(1028, 0.015))
 	statObjsDeleted    = metrics.NewRegisteredCounter("objs_deleted_total", nil)
 )
 
-func (client *S3) DeleteBucket(bucket string) error {
-	log.Printf("removing bucket %s", bucket)
-	_, err := client.S3.DeleteBucketRequest(&s3.DeleteBucketInput{
+func (client *S3) DeleteBucket(ctx context.Context, bucket string) error {
+	LogDebug("bucket_removing", Fields{"bucket": bucket}, "removing bucket %s", bucket)
+	req := client.forBucket(bucket).DeleteBucketRequest(&s3.DeleteBucketInput{
 		Bucket: &bucket,
-	}).Send()
-	statClientRequests.Inc(1)
-	return err
+	})
+	req.SetContext(ctx)
+	start := time.Now()
+	_, err := req.Send()
+	observeRequest("DeleteBucket", start, err)
+	if err != nil {
+		return &BucketError{Bucket: bucket, Op: "DeleteBucket", Err: err}
+	}
+	return nil
 }
 
-func (client *S3) MustDeleteBucket(bucket string) {
-	if err := client.DeleteBucket(bucket); err != nil {
-		log.Fatalf("error while deleting bucket %s: %v", bucket, err)
+func (client *S3) MustDeleteBucket(ctx context.Context, bucket string) {
+	if err := client.DeleteBucket(ctx, bucket); err != nil {
+		LogFatal("bucket_remove_failed", Fields{"bucket": bucket, "error": err}, "%v", err)
 	}
 }
 
-func (client *S3) DeleteObjectVersions(bucket string, objects []s3.ObjectIdentifier) error {
-	statDeletesPending.Inc(1)
-	out, err := client.DeleteObjectsRequest(&s3.DeleteObjectsInput{
-		Bucket: &bucket,
-		Delete: &s3.Delete{
-			Objects: objects,
-		},
-	}).Send()
-	statClientRequests.Inc(1)
-	statDeletesPending.Dec(1)
+// DeleteObjectVersions deletes a batch of object versions, retrying the
+// request or individual keys according to the client's retry policy.  Any
+// failure that remains is returned as a *DeleteError.
+func (client *S3) DeleteObjectVersions(ctx context.Context, bucket string, versions []Version) error {
+	pending := identifiers(versions)
+	var failed []KeyError
+	for attempt := 1; ; attempt++ {
+		keys := make([]string, len(pending))
+		for i := range pending {
+			keys[i] = aws.StringValue(pending[i].Key)
+		}
+		if err := client.Limits.waitDeletes(ctx, bucket, keys); err != nil {
+			return &DeleteError{Bucket: bucket, Err: err, Keys: failed}
+		}
 
-	if err != nil {
-		if err, ok := err.(awserr.Error); ok && err.Code() == ErrCodeInternalError {
-			return client.DeleteObjectVersions(bucket, objects)
+		statDeletesPending.Inc(1)
+		statDeleteBatch.Update(int64(len(pending)))
+		req := client.forBucket(bucket).DeleteObjectsRequest(&s3.DeleteObjectsInput{
+			Bucket: &bucket,
+			Delete: &s3.Delete{
+				Objects: pending,
+			},
+		})
+		req.SetContext(ctx)
+		start := time.Now()
+		out, err := req.Send()
+		observeRequest("DeleteObjects", start, err)
+		client.noteDeleteRoundTrip(start)
+		statDeletesPending.Dec(1)
+
+		if err != nil {
+			client.noteThrottle(errorCode(err))
+			if client.Retry.retryable(err) && client.Retry.wait(ctx, attempt) {
+				continue
+			}
+			return &DeleteError{Bucket: bucket, Err: err, Keys: failed}
 		}
-		log.Fatalf("error while deleting: %v", err)
-	}
 
-	statObjsDeleted.Inc(int64(len(out.Deleted)))
+		statObjsDeleted.Inc(int64(len(out.Deleted)))
+		labeledCounter("objs_deleted_total", "bucket", bucket).Inc(int64(len(out.Deleted)))
+		if client.Audit != nil {
+			records := auditRecords(bucket, versions, out, req.RequestID, time.Now())
+			if err := client.Audit(records); err != nil {
+				return &AuditError{Bucket: bucket, Err: err}
+			}
+		}
 
-	if len(out.Errors) > 0 {
-		retryableObjects := make([]s3.ObjectIdentifier, 0)
+		pending = make([]s3.ObjectIdentifier, 0)
+		var retryable []KeyError
 		for _, err := range out.Errors {
-			if *err.Code == ErrCodeInternalError {
-				retryableObjects = append(retryableObjects, s3.ObjectIdentifier{
-					Key:       err.Key,
-					VersionId: err.VersionId,
-				})
+			keyErr := KeyError{
+				Key:       aws.StringValue(err.Key),
+				VersionId: aws.StringValue(err.VersionId),
+				Code:      aws.StringValue(err.Code),
+				Message:   aws.StringValue(err.Message),
+			}
+			client.noteThrottle(keyErr.Code)
+			if !client.Retry.RetryableCodes[keyErr.Code] {
+				failed = append(failed, keyErr)
+				continue
 			}
+			retryable = append(retryable, keyErr)
+			pending = append(pending, s3.ObjectIdentifier{
+				Key:       err.Key,
+				VersionId: err.VersionId,
+			})
 		}
 
-		if len(retryableObjects) == len(out.Errors) { // all failures are retryable
-			return client.DeleteObjectVersions(bucket, retryableObjects)
+		if len(pending) == 0 {
+			break
+		}
+		if !client.Retry.wait(ctx, attempt) {
+			failed = append(failed, retryable...)
+			break
 		}
-		log.Fatalf("non-retryable errors while deleting: %v", out.Errors)
 	}
 
-	return err
+	if len(failed) > 0 {
+		return &DeleteError{Bucket: bucket, Keys: failed}
+	}
+	return nil
 }
-func (client *S3) MustDeleteObjectVersions(bucket string, objects []s3.ObjectIdentifier) {
-	err := client.DeleteObjectVersions(bucket, objects)
-	if err != nil {
-		log.Fatalf("error while deleting: %v", err)
+
+// auditRecords returns a record of each deleted and failed version in the
+// response out to a request for versions.
+func auditRecords(bucket string, versions []Version, out *s3.DeleteObjectsOutput, requestId string, now time.Time) []AuditRecord {
+	type id struct{ key, versionId string }
+	byId := make(map[id]*Version, len(versions))
+	for i := range versions {
+		v := &versions[i]
+		byId[id{v.Key, v.VersionId}] = v
+	}
+	record := func(key, versionId string) AuditRecord {
+		r := AuditRecord{
+			Bucket:    bucket,
+			Key:       key,
+			VersionId: versionId,
+			DeletedAt: now.UTC(),
+			RequestId: requestId,
+		}
+		if v := byId[id{key, versionId}]; v != nil {
+			r.DeleteMarker = v.DeleteMarker
+			r.Size = v.Size
+			r.LastModified = v.LastModified
+		}
+		return r
+	}
+
+	records := make([]AuditRecord, 0, len(out.Deleted)+len(out.Errors))
+	for _, d := range out.Deleted {
+		r := record(aws.StringValue(d.Key), aws.StringValue(d.VersionId))
+		r.DeleteMarker = r.DeleteMarker || aws.BoolValue(d.DeleteMarker)
+		records = append(records, r)
+	}
+	for _, e := range out.Errors {
+		r := record(aws.StringValue(e.Key), aws.StringValue(e.VersionId))
+		r.Failed = true
+		r.Code = aws.StringValue(e.Code)
+		r.Message = aws.StringValue(e.Message)
+		records = append(records, r)
+	}
+	return records
+}
+
+func (client *S3) MustDeleteObjectVersions(ctx context.Context, bucket string, versions []Version) {
+	if err := client.DeleteObjectVersions(ctx, bucket, versions); err != nil {
+		LogFatal("delete_failed", Fields{"bucket": bucket, "count": len(versions), "error": err}, "%v", err)
 	}
 }
@@ -0,0 +1,139 @@
+// Copyright 2018 Sergey Grankin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s3util
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/sgrankin/s3-purge-bucket/s3util/s3test"
+)
+
+func allVersions(t *testing.T, client *S3) []Version {
+	versions, _ := listAll(t, client, "", Marker{})
+	return versions
+}
+
+func TestDeleteObjectVersions(t *testing.T) {
+	client, srv := newTestClient(t)
+	defer srv.Close()
+	putVersions(srv, 20, 2)
+	srv.Fail(s3test.OpDeleteObjects, ErrCodeInternalError, 1)
+	srv.FailKeys(ErrCodeSlowDown, 5)
+
+	err := client.DeleteObjectVersions(context.Background(), "bucket", allVersions(t, client))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if left := srv.Versions("bucket"); len(left) != 0 {
+		t.Errorf("%d versions left after delete", len(left))
+	}
+	if n := srv.Requests(s3test.OpDeleteObjects); n != 3 {
+		t.Errorf("sent %d requests, want 3: a failed one, the batch and the throttled keys", n)
+	}
+}
+
+func TestDeleteObjectVersionsKeyErrors(t *testing.T) {
+	client, srv := newTestClient(t)
+	defer srv.Close()
+	putVersions(srv, 10, 1)
+	srv.FailKeys("AccessDenied", 2)
+
+	err := client.DeleteObjectVersions(context.Background(), "bucket", allVersions(t, client))
+	de, ok := err.(*DeleteError)
+	if !ok {
+		t.Fatalf("got error %v, want a *DeleteError", err)
+	}
+	if len(de.Keys) != 2 || de.Keys[0].Code != "AccessDenied" {
+		t.Errorf("failed keys = %+v, want 2 AccessDenied", de.Keys)
+	}
+	if left := srv.Versions("bucket"); len(left) != 2 {
+		t.Errorf("%d versions left after delete, want 2", len(left))
+	}
+}
+
+func TestDeleteObjectVersionsAudit(t *testing.T) {
+	client, srv := newTestClient(t)
+	defer srv.Close()
+	putVersions(srv, 10, 1)
+	srv.FailKeys("AccessDenied", 2)
+	var records []AuditRecord
+	client.Audit = func(batch []AuditRecord) error {
+		records = append(records, batch...)
+		return nil
+	}
+
+	versions := allVersions(t, client)
+	client.DeleteObjectVersions(context.Background(), "bucket", versions)
+	if len(records) != len(versions) {
+		t.Fatalf("audited %d records, want %d", len(records), len(versions))
+	}
+	var failed int
+	for _, r := range records {
+		if r.Failed {
+			failed++
+			if r.Code != "AccessDenied" {
+				t.Errorf("failed record %+v, want AccessDenied", r)
+			}
+		}
+		if r.Bucket != "bucket" || r.RequestId == "" || r.DeletedAt.IsZero() || r.LastModified.IsZero() {
+			t.Errorf("incomplete record %+v", r)
+		}
+	}
+	if failed != 2 {
+		t.Errorf("audited %d failures, want 2", failed)
+	}
+
+	putVersions(srv, 1, 1)
+	client.Audit = func([]AuditRecord) error { return errors.New("disk full") }
+	err := client.DeleteObjectVersions(context.Background(), "bucket", allVersions(t, client))
+	if _, ok := err.(*AuditError); !ok {
+		t.Errorf("got error %v, want an *AuditError", err)
+	}
+}
+
+func TestDeleteObjectVersionsGivesUp(t *testing.T) {
+	client, srv := newTestClient(t)
+	defer srv.Close()
+	putVersions(srv, 3, 1)
+	client.Retry.MaxAttempts = 4
+	srv.Fail(s3test.OpDeleteObjects, ErrCodeInternalError, 10)
+
+	err := client.DeleteObjectVersions(context.Background(), "bucket", allVersions(t, client))
+	if de, ok := err.(*DeleteError); !ok || errorCode(de.Err) != ErrCodeInternalError {
+		t.Fatalf("got error %v, want an InternalError *DeleteError", err)
+	}
+	if n := srv.Requests(s3test.OpDeleteObjects); n != 4 {
+		t.Errorf("sent %d requests, want 4", n)
+	}
+}
+
+func TestDeleteBucket(t *testing.T) {
+	client, srv := newTestClient(t)
+	defer srv.Close()
+	srv.Put("bucket", s3test.Object{Key: "key"})
+
+	if err := client.DeleteBucket(context.Background(), "bucket"); err == nil || errorCode(err.(*BucketError).Err) != "BucketNotEmpty" {
+		t.Errorf("deleting a non-empty bucket: got %v, want BucketNotEmpty", err)
+	}
+	client.MustDeleteObjectVersions(context.Background(), "bucket", allVersions(t, client))
+	if err := client.DeleteBucket(context.Background(), "bucket"); err != nil {
+		t.Fatal(err)
+	}
+	if srv.HasBucket("bucket") {
+		t.Error("bucket still exists")
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright 2018 Sergey Grankin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s3util
+
+import (
+	"fmt"
+)
+
+// KeyError is a failure to delete a single object version, as reported in
+// the Errors of a DeleteObjects response.
+type KeyError struct {
+	Key       string
+	VersionId string
+	Code      string
+	Message   string
+}
+
+func (e KeyError) Error() string {
+	return fmt.Sprintf("%s (version %s): %s: %s", e.Key, e.VersionId, e.Code, e.Message)
+}
+
+// DeleteError is returned when a DeleteObjects batch fails.  Either the whole
+// request failed (Err is set) or individual keys could not be deleted (Keys is
+// non-empty); keys not mentioned were deleted.
+type DeleteError struct {
+	Bucket string
+	Err    error
+	Keys   []KeyError
+}
+
+func (e *DeleteError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("deleting from %s: %v", e.Bucket, e.Err)
+	}
+	return fmt.Sprintf("deleting from %s: %d keys failed, first: %v", e.Bucket, len(e.Keys), e.Keys[0])
+}
+
+func (e *DeleteError) Unwrap() error { return e.Err }
+
+// ListError is returned when listing fails.  The markers are those of the page
+// that could not be fetched, and can be used to resume the listing.  When
+// listing multipart uploads, Uploads is set and UploadIdMarker is used instead
+// of VersionIdMarker.
+type ListError struct {
+	Bucket          string
+	Prefix          string
+	Uploads         bool
+	KeyMarker       string
+	VersionIdMarker string
+	UploadIdMarker  string
+	Err             error
+}
+
+func (e *ListError) Error() string {
+	if e.Uploads {
+		return fmt.Sprintf("listing uploads in %s/%s at key %q upload %q: %v",
+			e.Bucket, e.Prefix, e.KeyMarker, e.UploadIdMarker, e.Err)
+	}
+	return fmt.Sprintf("listing %s/%s at key %q version %q: %v",
+		e.Bucket, e.Prefix, e.KeyMarker, e.VersionIdMarker, e.Err)
+}
+
+func (e *ListError) Unwrap() error { return e.Err }
+
+// UploadError is returned when a multipart upload could not be aborted.
+type UploadError struct {
+	Bucket string
+	Upload Upload
+	Err    error
+}
+
+func (e *UploadError) Error() string {
+	return fmt.Sprintf("aborting upload %s of %s/%s: %v", e.Upload.UploadId, e.Bucket, e.Upload.Key, e.Err)
+}
+
+func (e *UploadError) Unwrap() error { return e.Err }
+
+// BucketError is returned when an operation on the bucket itself fails.
+type BucketError struct {
+	Bucket string
+	Op     string
+	Err    error
+}
+
+func (e *BucketError) Error() string {
+	return fmt.Sprintf("%s %s: %v", e.Op, e.Bucket, e.Err)
+}
+
+func (e *BucketError) Unwrap() error { return e.Err }
+
+// AuditError is returned when the outcome of a DeleteObjects batch could not
+// be recorded in the audit log.  The deletes themselves took effect.
+type AuditError struct {
+	Bucket string
+	Err    error
+}
+
+func (e *AuditError) Error() string {
+	return fmt.Sprintf("auditing deletes from %s: %v", e.Bucket, e.Err)
+}
+
+func (e *AuditError) Unwrap() error { return e.Err }
@@ -0,0 +1,138 @@
+// Copyright 2018 Sergey Grankin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s3util
+
+import (
+	"time"
+)
+
+// A Filter reports whether a listed version should be deleted.
+type Filter func(v *Version) bool
+
+// ModifiedBefore selects versions last modified strictly before t.
+func ModifiedBefore(t time.Time) Filter {
+	return func(v *Version) bool {
+		return v.LastModified.Before(t)
+	}
+}
+
+// ModifiedAfter selects versions last modified strictly after t.
+func ModifiedAfter(t time.Time) Filter {
+	return func(v *Version) bool {
+		return v.LastModified.After(t)
+	}
+}
+
+// Noncurrent selects versions and delete markers that are not the latest
+// version of their key.
+func Noncurrent(v *Version) bool {
+	return !v.IsLatest
+}
+
+// DeleteMarkers selects delete markers.
+func DeleteMarkers(v *Version) bool {
+	return v.DeleteMarker
+}
+
+// StorageClasses selects object versions in any of the given storage classes.
+// Delete markers have no storage class and are never selected.
+func StorageClasses(classes ...string) Filter {
+	set := make(map[string]bool, len(classes))
+	for _, c := range classes {
+		set[c] = true
+	}
+	return func(v *Version) bool {
+		return !v.DeleteMarker && set[v.StorageClass]
+	}
+}
+
+// SizeAtLeast selects object versions of at least n bytes.
+func SizeAtLeast(n int64) Filter {
+	return func(v *Version) bool {
+		return !v.DeleteMarker && v.Size >= n
+	}
+}
+
+// SizeAtMost selects object versions of at most n bytes.  Delete markers are
+// not selected, although they have no size.
+func SizeAtMost(n int64) Filter {
+	return func(v *Version) bool {
+		return !v.DeleteMarker && v.Size <= n
+	}
+}
+
+// KeepNewest returns a Filter that keeps the n newest object versions of every
+// key and selects the older ones, along with delete markers older than the
+// last version kept.  It relies on seeing every version in listing order and
+// keeps state between calls, so each listing needs its own; place it first in
+// AllOf so that it sees versions other filters reject.
+func KeepNewest(n int) Filter {
+	var key string
+	var kept int
+	return func(v *Version) bool {
+		if v.Key != key {
+			key, kept = v.Key, 0
+		}
+		if kept >= n {
+			return true
+		}
+		if !v.DeleteMarker {
+			kept++
+		}
+		return false
+	}
+}
+
+// AllOf selects versions selected by every filter.
+func AllOf(filters ...Filter) Filter {
+	return func(v *Version) bool {
+		for _, f := range filters {
+			if !f(v) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// EachOf selects versions selected by every filter, like AllOf, but always
+// evaluates every filter, so that filters counting what they see, like those
+// of key rules, see every version.
+func EachOf(filters ...Filter) Filter {
+	return func(v *Version) bool {
+		selected := true
+		for _, f := range filters {
+			if !f(v) {
+				selected = false
+			}
+		}
+		return selected
+	}
+}
+
+// Select returns the versions selected by f, in order.  A nil Filter selects
+// everything.
+func (f Filter) Select(versions []Version) []Version {
+	if f == nil {
+		return versions
+	}
+	selected := make([]Version, 0, len(versions))
+	for i := range versions {
+		if f(&versions[i]) {
+			selected = append(selected, versions[i])
+		}
+	}
+	return selected
+}
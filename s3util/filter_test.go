@@ -0,0 +1,172 @@
+// Copyright 2018 Sergey Grankin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s3util
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStorageClasses(t *testing.T) {
+	f := StorageClasses("GLACIER", "DEEP_ARCHIVE")
+	for _, tc := range []struct {
+		v    Version
+		want bool
+	}{
+		{Version{StorageClass: "GLACIER"}, true},
+		{Version{StorageClass: "DEEP_ARCHIVE"}, true},
+		{Version{StorageClass: "STANDARD"}, false},
+		{Version{StorageClass: "glacier"}, false},
+		{Version{DeleteMarker: true}, false},
+	} {
+		if got := f(&tc.v); got != tc.want {
+			t.Errorf("StorageClasses selected %+v: %v, want %v", tc.v, got, tc.want)
+		}
+	}
+}
+
+func TestSizeFilters(t *testing.T) {
+	for _, tc := range []struct {
+		v           Version
+		least, most bool // selected by SizeAtLeast(10), SizeAtMost(10)
+	}{
+		{Version{Size: 0}, false, true},
+		{Version{Size: 9}, false, true},
+		{Version{Size: 10}, true, true},
+		{Version{Size: 11}, true, false},
+		{Version{DeleteMarker: true}, false, false},
+	} {
+		if got := SizeAtLeast(10)(&tc.v); got != tc.least {
+			t.Errorf("SizeAtLeast(10) selected %+v: %v, want %v", tc.v, got, tc.least)
+		}
+		if got := SizeAtMost(10)(&tc.v); got != tc.most {
+			t.Errorf("SizeAtMost(10) selected %+v: %v, want %v", tc.v, got, tc.most)
+		}
+	}
+}
+
+// ids returns the version IDs of versions, concatenated.
+func ids(versions []Version) string {
+	s := ""
+	for _, v := range versions {
+		s += v.VersionId
+	}
+	return s
+}
+
+func TestKeepNewest(t *testing.T) {
+	versions := []Version{
+		{Key: "a", VersionId: "1", IsLatest: true},
+		{Key: "a", VersionId: "2"},
+		{Key: "a", VersionId: "3"},
+		{Key: "b", VersionId: "4", IsLatest: true},
+		{Key: "c", VersionId: "5", IsLatest: true},
+		{Key: "c", VersionId: "6"},
+		{Key: "c", VersionId: "7"},
+	}
+	for _, tc := range []struct {
+		n    int
+		want string
+	}{
+		{0, "1234567"},
+		{1, "2367"},
+		{2, "37"},
+		{3, ""},
+	} {
+		if got := ids(KeepNewest(tc.n).Select(versions)); got != tc.want {
+			t.Errorf("KeepNewest(%d) selected %q, want %q", tc.n, got, tc.want)
+		}
+	}
+}
+
+func TestKeepNewestAcrossPages(t *testing.T) {
+	// The versions of b span both pages; its count carries over.
+	pages := [][]Version{
+		{
+			{Key: "a", VersionId: "1", IsLatest: true},
+			{Key: "b", VersionId: "2", IsLatest: true},
+			{Key: "b", VersionId: "3"},
+		},
+		{
+			{Key: "b", VersionId: "4"},
+			{Key: "b", VersionId: "5"},
+			{Key: "c", VersionId: "6", IsLatest: true},
+			{Key: "c", VersionId: "7"},
+		},
+	}
+	f := KeepNewest(2)
+	got := ""
+	for _, page := range pages {
+		got += ids(f.Select(page))
+	}
+	if want := "45"; got != want {
+		t.Errorf("selected %q across pages, want %q", got, want)
+	}
+}
+
+func TestKeepNewestDeleteMarkers(t *testing.T) {
+	// Delete markers don't count among the versions kept: those newer than
+	// the last version kept are kept, and older ones selected.
+	versions := []Version{
+		{Key: "a", VersionId: "1", IsLatest: true, DeleteMarker: true},
+		{Key: "a", VersionId: "2"},
+		{Key: "a", VersionId: "3", DeleteMarker: true},
+		{Key: "a", VersionId: "4"},
+		{Key: "a", VersionId: "5", DeleteMarker: true},
+		{Key: "a", VersionId: "6"},
+		{Key: "b", VersionId: "7", IsLatest: true, DeleteMarker: true},
+	}
+	for _, tc := range []struct {
+		n    int
+		want string
+	}{
+		{1, "3456"},
+		{2, "56"},
+		{3, ""},
+	} {
+		if got := ids(KeepNewest(tc.n).Select(versions)); got != tc.want {
+			t.Errorf("KeepNewest(%d) selected %q, want %q", tc.n, got, tc.want)
+		}
+	}
+}
+
+func TestKeepNewestWithFilters(t *testing.T) {
+	now := time.Now()
+	versions := []Version{
+		{Key: "a", VersionId: "1", IsLatest: true, LastModified: now.Add(-1 * time.Hour), Size: 10},
+		{Key: "a", VersionId: "2", LastModified: now.Add(-2 * time.Hour), Size: 100},
+		{Key: "a", VersionId: "3", LastModified: now.Add(-3 * time.Hour), Size: 10},
+		{Key: "a", VersionId: "4", LastModified: now.Add(-4 * time.Hour), Size: 100},
+	}
+	cutoff := now.Add(-90 * time.Minute)
+	for _, tc := range []struct {
+		name string
+		f    Filter
+		want string
+	}{
+		// First, KeepNewest keeps the newest versions overall, and the
+		// other filters pick among the rest.
+		{"age", AllOf(KeepNewest(2), ModifiedBefore(cutoff)), "34"},
+		{"size", AllOf(KeepNewest(1), SizeAtLeast(50)), "24"},
+		// Placed after them, it only sees the versions they selected, so
+		// it keeps the newest of those instead.
+		{"age first", AllOf(ModifiedBefore(cutoff), KeepNewest(2)), "4"},
+		{"size first", AllOf(SizeAtLeast(50), KeepNewest(1)), "4"},
+	} {
+		if got := ids(tc.f.Select(versions)); got != tc.want {
+			t.Errorf("%s: selected %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
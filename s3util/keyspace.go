@@ -0,0 +1,124 @@
+// Copyright 2018 Sergey Grankin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s3util
+
+import (
+	"context"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// Split keys are made of printable ASCII, which is valid in any marker and
+// covers the bulk of real key spaces.  Keys outside of it still sort into the
+// right range; the split is just less even.
+const (
+	minSplitChar = 0x20
+	maxSplitChar = 0x7e
+)
+
+// MidKey returns a key roughly halfway between lo and hi such that
+// lo < mid < hi, or false if there is none made of printable ASCII.  An empty
+// hi is unbounded.
+func MidKey(lo, hi string) (string, bool) {
+	if hi != "" && lo >= hi {
+		return "", false
+	}
+
+	i := 0
+	if hi != "" {
+		for i < len(lo) && lo[i] == hi[i] {
+			i++
+		}
+	}
+
+	a := minSplitChar - 1 // lo ended: anything at i sorts after it
+	if i < len(lo) {
+		a = int(lo[i])
+	}
+	b := maxSplitChar + 1
+	if hi != "" {
+		b = int(hi[i])
+	}
+
+	first, last := a+1, b-1
+	if first < minSplitChar {
+		first = minSplitChar
+	}
+	if last > maxSplitChar {
+		last = maxSplitChar
+	}
+	if first <= last {
+		return lo[:i] + string(rune((first+last+1)/2)), true
+	}
+
+	if i >= len(lo) {
+		return "", false
+	}
+	// lo[i] and hi[i] are adjacent: anything after lo that starts with
+	// lo[:i+1] is below hi.
+	rest, ok := MidKey(lo[i+1:], "")
+	return lo[:i+1] + rest, ok
+}
+
+// PrefixEnd returns the smallest key greater than every key under prefix, or
+// "" (unbounded) if there is none.
+func PrefixEnd(prefix string) string {
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] < 0xff {
+			return prefix[:i] + string([]byte{prefix[i] + 1})
+		}
+	}
+	return ""
+}
+
+// KeyPoint maps a key onto [0, 1] relative to the keys under prefix,
+// preserving order, by reading the rest of the key as a base-256 fraction.
+// Keys before the prefix map to 0 and keys after it to 1.  It is precise to
+// about the first 6 bytes, which is enough to compare the sizes of key ranges.
+func KeyPoint(prefix, key string) float64 {
+	if !strings.HasPrefix(key, prefix) {
+		if key < prefix {
+			return 0
+		}
+		return 1
+	}
+	key = key[len(prefix):]
+	point, scale := 0.0, 1.0
+	for i := 0; i < len(key) && i < 8; i++ {
+		scale /= 256
+		point += float64(key[i]) * scale
+	}
+	return point
+}
+
+// CommonPrefixes returns up to a page of the common prefixes of keys under
+// prefix, split at the first delimiter after it.
+func (client *S3) CommonPrefixes(ctx context.Context, bucket, prefix, delimiter string) ([]string, error) {
+	out, err := client.listObjectVersionsPage(ctx, &s3.ListObjectVersionsInput{
+		Bucket:    &bucket,
+		Prefix:    &prefix,
+		Delimiter: &delimiter,
+	})
+	if err != nil {
+		return nil, &ListError{Bucket: bucket, Prefix: prefix, Err: err}
+	}
+	prefixes := make([]string, 0, len(out.CommonPrefixes))
+	for _, cp := range out.CommonPrefixes {
+		prefixes = append(prefixes, aws.StringValue(cp.Prefix))
+	}
+	return prefixes, nil
+}
@@ -0,0 +1,91 @@
+// Copyright 2018 Sergey Grankin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s3util
+
+import "testing"
+
+func TestMidKey(t *testing.T) {
+	for _, tc := range []struct {
+		lo, hi string
+		want   string
+		ok     bool
+	}{
+		{"", "", "O", true},
+		{"a", "", "p", true},
+		{"", "b", "A", true},
+		{"a", "c", "b", true},
+		{"a", "b", "aO", true},    // adjacent
+		{"ab", "ac", "abO", true}, // adjacent after a common prefix
+		{"a~", "b", "a~O", true},  // nothing printable after ~
+		{"\xff\xff", "", "\xff\xffO", true},
+		{"a", "a\x00", "", false}, // nothing in between
+		{"a", "a", "", false},
+		{"b", "a", "", false},
+	} {
+		mid, ok := MidKey(tc.lo, tc.hi)
+		if mid != tc.want || ok != tc.ok {
+			t.Errorf("MidKey(%q, %q) = %q, %v, want %q, %v", tc.lo, tc.hi, mid, ok, tc.want, tc.ok)
+		}
+		if ok && (mid <= tc.lo || tc.hi != "" && mid >= tc.hi) {
+			t.Errorf("MidKey(%q, %q) = %q, not between them", tc.lo, tc.hi, mid)
+		}
+	}
+}
+
+func TestPrefixEnd(t *testing.T) {
+	for _, tc := range []struct{ prefix, want string }{
+		{"", ""},
+		{"a", "b"},
+		{"a/", "a0"},
+		{"a\xff", "b"},
+		{"a\xff\xff", "b"},
+		{"\xff\xff", ""}, // every key after it is under it
+	} {
+		if got := PrefixEnd(tc.prefix); got != tc.want {
+			t.Errorf("PrefixEnd(%q) = %q, want %q", tc.prefix, got, tc.want)
+		}
+	}
+}
+
+func TestKeyPoint(t *testing.T) {
+	for _, tc := range []struct {
+		prefix, key string
+		want        float64
+	}{
+		{"p/", "p/", 0},
+		{"p/", "a", 0}, // before the prefix
+		{"p/", "q", 1}, // after it
+		{"", "\x80", 0.5},
+		{"p/", "p/\x80", 0.5},
+		{"", "\xff", 255.0 / 256},
+	} {
+		if got := KeyPoint(tc.prefix, tc.key); got != tc.want {
+			t.Errorf("KeyPoint(%q, %q) = %g, want %g", tc.prefix, tc.key, got, tc.want)
+		}
+	}
+
+	// Order is preserved, though keys differing only in trailing zero
+	// bytes map to the same point.
+	ordered := []string{"", "a", "a\x00", "ab", "b", "b\xff\xff", "c"}
+	for i := 1; i < len(ordered); i++ {
+		if KeyPoint("", ordered[i-1]) > KeyPoint("", ordered[i]) {
+			t.Errorf("KeyPoint(%q) > KeyPoint(%q)", ordered[i-1], ordered[i])
+		}
+	}
+	// Bytes past the eighth don't count.
+	if a, b := KeyPoint("", "abcdefghX"), KeyPoint("", "abcdefghY"); a != b {
+		t.Errorf("KeyPoint differs past 8 bytes: %g, %g", a, b)
+	}
+}
@@ -15,8 +15,11 @@
 package s3util
 
 import (
-	"log"
+	"context"
+	"errors"
+	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/rcrowley/go-metrics"
 )
@@ -25,49 +28,260 @@ var (
 	statObjsListed = metrics.NewRegisteredCounter("objs_listed_total", nil)
 )
 
+// Marker is a position in a version listing.  The zero Marker is the start.
+type Marker struct {
+	KeyMarker       string
+	VersionIdMarker string
+}
+
+// Version is an object version or delete marker, as listed.
+type Version struct {
+	Key          string
+	VersionId    string
+	IsLatest     bool
+	DeleteMarker bool
+	LastModified time.Time
+	Size         int64
+	StorageClass string
+}
+
+// identifiers returns the identifiers of versions, as used by DeleteObjects.
+func identifiers(versions []Version) []s3.ObjectIdentifier {
+	ids := make([]s3.ObjectIdentifier, len(versions))
+	for i := range versions {
+		ids[i] = s3.ObjectIdentifier{
+			Key:       &versions[i].Key,
+			VersionId: &versions[i].VersionId,
+		}
+	}
+	return ids
+}
+
+// Page is a single page of a version listing.
+type Page struct {
+	// Versions holds both object versions and delete markers, ordered by key
+	// and then newest first.
+	Versions []Version
+
+	// Next is the position immediately after this page; listing from it
+	// continues with the following page.
+	Next Marker
+
+	// Last is set on the final page of the listing.
+	Last bool
+}
+
+// ListObjectVersions pages through every version and delete marker under
+// the prefix, starting after start, and passes each page to out.  Pages may be
+// empty.  Each page is retried according to the client's retry policy; a
+// failure that remains, or ctx being done, is returned as a *ListError
+// carrying the markers of the page that was not fetched.  An error from out
+// stops the listing and is returned as is.
 func (client *S3) ListObjectVersions(
-	bucket string, prefix string,
-	out func(objects []s3.ObjectIdentifier),
+	ctx context.Context,
+	bucket string, prefix string, start Marker,
+	out func(page *Page) error,
 ) error {
-	req := client.ListObjectVersionsRequest(&s3.ListObjectVersionsInput{
-		Bucket: &bucket,
-		Prefix: &prefix,
-	})
-
-	pager := req.Paginate()
-	for pager.Next() {
-		statClientRequests.Inc(1)
+	marker := start
+	for {
+		input := &s3.ListObjectVersionsInput{
+			Bucket: &bucket,
+			Prefix: &prefix,
+		}
+		if marker.KeyMarker != "" {
+			input.KeyMarker = aws.String(marker.KeyMarker)
+		}
+		// S3 rejects an empty version ID marker, as ranges starting at a
+		// key alone would send.
+		if marker.VersionIdMarker != "" {
+			input.VersionIdMarker = aws.String(marker.VersionIdMarker)
+		}
+		page, err := client.listObjectVersionsPage(ctx, input)
+		if err != nil {
+			return &ListError{
+				Bucket:          bucket,
+				Prefix:          prefix,
+				KeyMarker:       marker.KeyMarker,
+				VersionIdMarker: marker.VersionIdMarker,
+				Err:             err,
+			}
+		}
 
-		page := pager.CurrentPage()
-		objects := make([]s3.ObjectIdentifier, 0, len(page.Versions)+len(page.DeleteMarkers))
+		versions := make([]Version, 0, len(page.Versions))
 		for _, ver := range page.Versions {
-			objects = append(objects, s3.ObjectIdentifier{
-				Key:       ver.Key,
-				VersionId: ver.VersionId,
+			versions = append(versions, Version{
+				Key:          aws.StringValue(ver.Key),
+				VersionId:    aws.StringValue(ver.VersionId),
+				IsLatest:     aws.BoolValue(ver.IsLatest),
+				LastModified: aws.TimeValue(ver.LastModified),
+				Size:         aws.Int64Value(ver.Size),
+				StorageClass: string(ver.StorageClass),
 			})
 		}
+		markers := make([]Version, 0, len(page.DeleteMarkers))
 		for _, ver := range page.DeleteMarkers {
-			objects = append(objects, s3.ObjectIdentifier{
-				Key:       ver.Key,
-				VersionId: ver.VersionId,
+			markers = append(markers, Version{
+				Key:          aws.StringValue(ver.Key),
+				VersionId:    aws.StringValue(ver.VersionId),
+				IsLatest:     aws.BoolValue(ver.IsLatest),
+				DeleteMarker: true,
+				LastModified: aws.TimeValue(ver.LastModified),
 			})
 		}
 
-		statObjsListed.Inc(int64(len(objects)))
+		versions = mergeVersions(versions, markers)
+		statObjsListed.Inc(int64(len(versions)))
+		labeledCounter("objs_listed_total", "bucket", bucket).Inc(int64(len(versions)))
+
+		last := !aws.BoolValue(page.IsTruncated)
+		if !last {
+			marker = Marker{
+				KeyMarker:       aws.StringValue(page.NextKeyMarker),
+				VersionIdMarker: aws.StringValue(page.NextVersionIdMarker),
+			}
+		}
+		if err := out(&Page{Versions: versions, Next: marker, Last: last}); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+// mergeVersions merges object versions and delete markers, which S3 returns
+// separately but each in listing order, back into a single listing.
+func mergeVersions(versions, markers []Version) []Version {
+	if len(markers) == 0 {
+		return versions
+	}
+	merged := make([]Version, 0, len(versions)+len(markers))
+	for len(versions) > 0 && len(markers) > 0 {
+		if listedBefore(&markers[0], &versions[0]) {
+			merged = append(merged, markers[0])
+			markers = markers[1:]
+		} else {
+			merged = append(merged, versions[0])
+			versions = versions[1:]
+		}
+	}
+	merged = append(merged, versions...)
+	return append(merged, markers...)
+}
+
+func listedBefore(a, b *Version) bool {
+	if a.Key != b.Key {
+		return a.Key < b.Key
+	}
+	if a.IsLatest != b.IsLatest {
+		return a.IsLatest
+	}
+	return a.LastModified.After(b.LastModified)
+}
+
+func (client *S3) listObjectVersionsPage(
+	ctx context.Context, input *s3.ListObjectVersionsInput,
+) (*s3.ListObjectVersionsOutput, error) {
+	for attempt := 1; ; attempt++ {
+		if err := client.Limits.waitList(ctx, *input.Bucket, aws.StringValue(input.Prefix)); err != nil {
+			return nil, err
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		req := client.forBucket(*input.Bucket).ListObjectVersionsRequest(input)
+		req.SetContext(ctx)
+		start := time.Now()
+		page, err := req.Send()
+		observeRequest("ListObjectVersions", start, err)
+		if err != nil {
+			client.noteThrottle(errorCode(err))
+		}
+		if err == nil || !client.Retry.retryable(err) || !client.Retry.wait(ctx, attempt) {
+			return page, err
+		}
+	}
+}
+
+// Sample is the first page of a listing.
+type Sample struct {
+	Count     int  // versions and delete markers in the first page
+	Truncated bool // whether there are more beyond the first page
+}
+
+// SampleObjectVersions counts the versions and delete markers in the first
+// page of a listing.
+func (client *S3) SampleObjectVersions(ctx context.Context, bucket string, prefix string) (Sample, error) {
+	out, err := client.listObjectVersionsPage(ctx, &s3.ListObjectVersionsInput{
+		Bucket: &bucket,
+		Prefix: &prefix,
+	})
+	if err != nil {
+		return Sample{}, &ListError{Bucket: bucket, Prefix: prefix, Err: err}
+	}
+	return Sample{
+		Count:     len(out.Versions) + len(out.DeleteMarkers),
+		Truncated: aws.BoolValue(out.IsTruncated),
+	}, nil
+}
+
+// errListed stops a listing once enough has been seen.
+var errListed = errors.New("listed enough")
 
-		if len(objects) > 0 {
-			out(objects)
+// ExpiredDeleteMarkers returns the delete markers in page that are the only
+// remaining version of their key.  Such a marker is the latest version of its
+// key and is not followed by another version of it; when it ends a truncated
+// page, that is checked by listing the key.
+func ExpiredDeleteMarkers(ctx context.Context, store ObjectStore, bucket string, page *Page) ([]Version, error) {
+	var expired []Version
+	versions := page.Versions
+	for i := range versions {
+		v := &versions[i]
+		if !v.DeleteMarker || !v.IsLatest {
+			continue
 		}
+		if i+1 < len(versions) {
+			if versions[i+1].Key == v.Key {
+				continue
+			}
+		} else if !page.Last {
+			only, err := hasOneVersion(ctx, store, bucket, v.Key)
+			if err != nil {
+				return nil, err
+			}
+			if !only {
+				continue
+			}
+		}
+		expired = append(expired, *v)
 	}
+	return expired, nil
+}
 
-	return pager.Err()
+// hasOneVersion reports whether key has a single version.  The key's versions
+// are listed first under the key as a prefix, so the first page decides.
+func hasOneVersion(ctx context.Context, store ObjectStore, bucket string, key string) (bool, error) {
+	count := 0
+	err := store.ListObjectVersions(ctx, bucket, key, Marker{}, func(page *Page) error {
+		for _, v := range page.Versions {
+			if v.Key == key {
+				count++
+			}
+		}
+		return errListed
+	})
+	if err != nil && err != errListed {
+		return false, err
+	}
+	return count <= 1, nil
 }
 
 func (client *S3) MustListObjectVersions(
-	bucket string, prefix string,
-	out func(objects []s3.ObjectIdentifier),
+	ctx context.Context,
+	bucket string, prefix string, start Marker,
+	out func(page *Page) error,
 ) {
-	if err := client.ListObjectVersions(bucket, prefix, out); err != nil {
-		log.Fatalf("error while listing %s/%s: %v", bucket, prefix, err)
+	if err := client.ListObjectVersions(ctx, bucket, prefix, start, out); err != nil {
+		LogFatal("list_failed", Fields{"bucket": bucket, "prefix": prefix, "error": err}, "%v", err)
 	}
 }
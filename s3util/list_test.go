@@ -0,0 +1,211 @@
+// Copyright 2018 Sergey Grankin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s3util
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/sgrankin/s3-purge-bucket/s3util/s3test"
+)
+
+func TestMain(m *testing.M) {
+	// The fake does not check signatures, but the SDK needs credentials to sign.
+	os.Setenv("AWS_ACCESS_KEY_ID", "test")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	os.Exit(m.Run())
+}
+
+// newTestClient returns a client for a fresh fake with a single bucket, with
+// retries fast enough for tests.
+func newTestClient(t *testing.T) (*S3, *s3test.Server) {
+	srv := s3test.NewServer()
+	srv.CreateBucket("bucket", "us-east-1")
+	client, err := NewClient("us-east-1", Endpoint{URL: srv.URL, PathStyle: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Retry.BaseDelay = time.Millisecond
+	client.Retry.MaxDelay = 5 * time.Millisecond
+	return client, srv
+}
+
+// putVersions stores versions of keys, some topped with delete markers.
+func putVersions(srv *s3test.Server, keys, versions int) {
+	for i := 0; i < keys; i++ {
+		key := fmt.Sprintf("dir%d/key%03d", i%3, i)
+		for j := 0; j < versions; j++ {
+			srv.Put("bucket", s3test.Object{Key: key, Size: int64(j)})
+		}
+		if i%4 == 0 {
+			srv.Put("bucket", s3test.Object{Key: key, DeleteMarker: true})
+		}
+	}
+}
+
+func listAll(t *testing.T, client *S3, prefix string, start Marker) (versions []Version, pages int) {
+	err := client.ListObjectVersions(context.Background(), "bucket", prefix, start, func(page *Page) error {
+		versions = append(versions, page.Versions...)
+		pages++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return versions, pages
+}
+
+func TestListObjectVersions(t *testing.T) {
+	client, srv := newTestClient(t)
+	defer srv.Close()
+	putVersions(srv, 20, 3)
+	srv.SetPageSize(7)
+
+	got, pages := listAll(t, client, "", Marker{})
+	want := srv.Versions("bucket")
+	if len(got) != len(want) {
+		t.Fatalf("listed %d versions, want %d", len(got), len(want))
+	}
+	for i := range want {
+		g, w := got[i], want[i]
+		if g.Key != w.Key || g.VersionId != w.VersionId || g.IsLatest != w.IsLatest ||
+			g.DeleteMarker != w.DeleteMarker || !g.LastModified.Equal(w.LastModified.Truncate(time.Millisecond)) {
+			t.Errorf("version %d = %+v, want %+v", i, g, w)
+		}
+	}
+	if wantPages := (len(want) + 6) / 7; pages != wantPages {
+		t.Errorf("listed %d pages, want %d", pages, wantPages)
+	}
+}
+
+func TestListObjectVersionsFromMarker(t *testing.T) {
+	client, srv := newTestClient(t)
+	defer srv.Close()
+	putVersions(srv, 10, 2)
+	srv.SetPageSize(3)
+
+	all := srv.Versions("bucket")
+	start := Marker{KeyMarker: all[4].Key, VersionIdMarker: all[4].VersionId}
+	got, _ := listAll(t, client, "", start)
+	if len(got) != len(all)-5 || got[0].VersionId != all[5].VersionId {
+		t.Errorf("listing after %+v started at %+v with %d versions, want %+v with %d",
+			start, got[0], len(got), all[5], len(all)-5)
+	}
+
+	got, _ = listAll(t, client, "dir1/", Marker{})
+	for _, v := range got {
+		if v.Key[:5] != "dir1/" {
+			t.Errorf("listed %q outside the prefix", v.Key)
+		}
+	}
+}
+
+func TestSampleObjectVersions(t *testing.T) {
+	client, srv := newTestClient(t)
+	defer srv.Close()
+	putVersions(srv, 20, 3)
+	total := len(srv.Versions("bucket"))
+
+	sample, err := client.SampleObjectVersions(context.Background(), "bucket", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Sample{Count: total}); sample != want {
+		t.Errorf("sampled %+v, want %+v", sample, want)
+	}
+
+	srv.SetPageSize(10)
+	sample, err = client.SampleObjectVersions(context.Background(), "bucket", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Sample{Count: 10, Truncated: true}); sample != want {
+		t.Errorf("sampled %+v, want %+v", sample, want)
+	}
+}
+
+func TestListObjectVersionsRetries(t *testing.T) {
+	client, srv := newTestClient(t)
+	defer srv.Close()
+	putVersions(srv, 5, 1)
+	srv.Fail(s3test.OpListObjectVersions, ErrCodeInternalError, 2)
+
+	got, _ := listAll(t, client, "", Marker{})
+	if want := len(srv.Versions("bucket")); len(got) != want {
+		t.Errorf("listed %d versions, want %d", len(got), want)
+	}
+	if n := srv.Requests(s3test.OpListObjectVersions); n != 3 {
+		t.Errorf("sent %d requests, want 3", n)
+	}
+}
+
+func TestListObjectVersionsGivesUp(t *testing.T) {
+	client, srv := newTestClient(t)
+	defer srv.Close()
+	client.Retry.MaxAttempts = 3
+	srv.Fail(s3test.OpListObjectVersions, ErrCodeSlowDown, 10)
+
+	err := client.ListObjectVersions(context.Background(), "bucket", "", Marker{}, func(*Page) error { return nil })
+	if le, ok := err.(*ListError); !ok || errorCode(le.Err) != ErrCodeSlowDown {
+		t.Fatalf("got error %v, want a SlowDown *ListError", err)
+	}
+	if n := srv.Requests(s3test.OpListObjectVersions); n != 3 {
+		t.Errorf("sent %d requests, want 3", n)
+	}
+}
+
+func TestCommonPrefixes(t *testing.T) {
+	client, srv := newTestClient(t)
+	defer srv.Close()
+	putVersions(srv, 12, 2)
+	srv.Put("bucket", s3test.Object{Key: "top"})
+
+	got, err := client.CommonPrefixes(context.Background(), "bucket", "", "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"dir0/", "dir1/", "dir2/"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("common prefixes = %q, want %q", got, want)
+	}
+}
+
+func TestExpiredDeleteMarkers(t *testing.T) {
+	client, srv := newTestClient(t)
+	defer srv.Close()
+	srv.Put("bucket", s3test.Object{Key: "a", DeleteMarker: true})
+	srv.Put("bucket", s3test.Object{Key: "b"})
+	srv.Put("bucket", s3test.Object{Key: "b", DeleteMarker: true})
+	srv.Put("bucket", s3test.Object{Key: "c", DeleteMarker: true})
+	srv.SetPageSize(2)
+
+	var expired []string
+	err := client.ListObjectVersions(context.Background(), "bucket", "", Marker{}, func(page *Page) error {
+		versions, err := ExpiredDeleteMarkers(context.Background(), client, "bucket", page)
+		for _, v := range versions {
+			expired = append(expired, v.Key)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a", "c"}; !reflect.DeepEqual(expired, want) {
+		t.Errorf("expired delete markers = %q, want %q", expired, want)
+	}
+}
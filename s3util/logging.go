@@ -0,0 +1,140 @@
+// Copyright 2018 Sergey Grankin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s3util
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// Level is the severity of a logged event.
+type Level int
+
+const (
+	LevelDebug Level = iota // progress of individual listers and requests
+	LevelInfo               // progress of the purge as a whole
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "error"}
+
+func (l Level) String() string {
+	if l < 0 || int(l) >= len(levelNames) {
+		return fmt.Sprintf("Level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel returns the level named name, e.g. "info".
+func ParseLevel(name string) (Level, error) {
+	for l, n := range levelNames {
+		if n == name {
+			return Level(l), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q", name)
+}
+
+// Fields are the details of a logged event, such as "bucket" or "count".
+type Fields map[string]interface{}
+
+var (
+	logJSON  bool
+	logLevel = LevelDebug
+)
+
+// SetLogFormat selects how events are written to the standard logger: "text"
+// writes the message alone, and "json" writes an object per line with the
+// time, level, event type, message and fields.
+func SetLogFormat(format string) error {
+	switch format {
+	case "text":
+		logJSON = false
+	case "json":
+		logJSON = true
+		log.SetFlags(0)
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+	return nil
+}
+
+// SetLogLevel discards events less severe than level.
+func SetLogLevel(level Level) {
+	logLevel = level
+}
+
+// logEvent logs an event of type event, described by format and args.
+func logEvent(level Level, event string, fields Fields, format string, args ...interface{}) {
+	if level < logLevel {
+		return
+	}
+	msg := fmt.Sprintf(format, args...)
+	if !logJSON {
+		if level == LevelError {
+			msg = "error: " + msg
+		}
+		log.Print(msg)
+		return
+	}
+
+	record := make(map[string]interface{}, len(fields)+4)
+	for k, v := range fields {
+		if err, ok := v.(error); ok {
+			v = err.Error()
+		}
+		record[k] = v
+	}
+	record["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	record["level"] = level.String()
+	record["event"] = event
+	record["msg"] = msg
+	line, err := json.Marshal(record)
+	if err != nil {
+		line, _ = json.Marshal(map[string]interface{}{
+			"time":  record["time"],
+			"level": LevelError.String(),
+			"event": "log_failed",
+			"msg":   msg,
+			"error": err.Error(),
+		})
+	}
+	log.Print(string(line))
+}
+
+// LogDebug logs an event of type event at LevelDebug.
+func LogDebug(event string, fields Fields, format string, args ...interface{}) {
+	logEvent(LevelDebug, event, fields, format, args...)
+}
+
+// LogInfo logs an event of type event at LevelInfo.
+func LogInfo(event string, fields Fields, format string, args ...interface{}) {
+	logEvent(LevelInfo, event, fields, format, args...)
+}
+
+// LogError logs an event of type event at LevelError.  In text, the message
+// is prefixed with "error: ".
+func LogError(event string, fields Fields, format string, args ...interface{}) {
+	logEvent(LevelError, event, fields, format, args...)
+}
+
+// LogFatal logs an event like LogError and exits.
+func LogFatal(event string, fields Fields, format string, args ...interface{}) {
+	logEvent(LevelError, event, fields, format, args...)
+	os.Exit(1)
+}
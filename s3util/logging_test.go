@@ -0,0 +1,90 @@
+// Copyright 2018 Sergey Grankin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s3util
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestLogJSON(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	flags := log.Flags()
+	defer func() {
+		log.SetOutput(os.Stderr)
+		log.SetFlags(flags)
+		SetLogFormat("text")
+		SetLogLevel(LevelDebug)
+	}()
+	if err := SetLogFormat("json"); err != nil {
+		t.Fatal(err)
+	}
+	SetLogLevel(LevelInfo)
+
+	LogDebug("range_listing", Fields{"bucket": "b"}, "listing %s", "b")
+	LogError("purge_failed", Fields{"bucket": "b", "count": 3, "error": errors.New("boom")}, "failed: %v", "boom")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("logged %d lines, want 1:\n%s", len(lines), buf.String())
+	}
+	var got map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got["time"] == nil {
+		t.Errorf("no time in %s", lines[0])
+	}
+	delete(got, "time")
+	want := map[string]interface{}{
+		"level":  "error",
+		"event":  "purge_failed",
+		"msg":    "failed: boom",
+		"bucket": "b",
+		"count":  3.0,
+		"error":  "boom",
+	}
+	if len(got) != len(want) {
+		t.Errorf("logged %v, want %v", got, want)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s = %v, want %v", k, got[k], v)
+		}
+	}
+}
+
+func TestLogText(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	flags := log.Flags()
+	log.SetFlags(0)
+	defer func() {
+		log.SetOutput(os.Stderr)
+		log.SetFlags(flags)
+	}()
+
+	LogInfo("bucket_removing", Fields{"bucket": "b"}, "removing bucket %s", "b")
+	LogError("checkpoint_failed", nil, "saving checkpoint: %v", "full")
+	if got, want := buf.String(), "removing bucket b\nerror: saving checkpoint: full\n"; got != want {
+		t.Errorf("logged %q, want %q", got, want)
+	}
+}
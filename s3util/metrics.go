@@ -17,38 +17,112 @@ package s3util
 import (
 	"bytes"
 	"fmt"
-	"log"
 	"sort"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/rcrowley/go-metrics"
 )
 
-func LogMetrics() {
+// labeledName returns the name of a series of the metric name with the given
+// label name/value pairs, in Prometheus syntax, e.g. requests_total{op="x"}.
+// go-metrics has no labels, so each series is registered as its own metric.
+func labeledName(name string, labels ...string) string {
+	var buf bytes.Buffer
+	buf.WriteString(name)
+	buf.WriteByte('{')
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.WriteString(labels[i])
+		buf.WriteString(`="`)
+		buf.WriteString(labelEscaper.Replace(labels[i+1]))
+		buf.WriteByte('"')
+	}
+	buf.WriteByte('}')
+	return buf.String()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labeledCounter returns the counter for a series of the metric name,
+// registering it on first use.
+func labeledCounter(name string, labels ...string) metrics.Counter {
+	return metrics.GetOrRegisterCounter(labeledName(name, labels...), nil)
+}
+
+// roundDuration rounds a duration in nanoseconds for logging.
+func roundDuration(ns float64) time.Duration {
+	return time.Duration(ns).Round(time.Microsecond)
+}
+
+// LogMetrics logs the value of every registered metric on a single line.
+// Labeled series are left out, as there may be many; they are only served
+// to Prometheus.
+// Timers and histograms are logged as their count, median, 99th percentile
+// and maximum.
+// In JSON, the values are the "metrics" field of a "metrics" event instead.
+// Metrics of unsupported types are skipped and reported in the returned error.
+func LogMetrics() error {
 	registry := metrics.DefaultRegistry
 
 	keys := make([]string, 0)
 	values := make(map[string]string)
+	fields := make(map[string]interface{})
+	var unknown []string
 
 	registry.Each(func(name string, i interface{}) {
-		keys = append(keys, name)
+		if strings.IndexByte(name, '{') >= 0 {
+			return
+		}
 		switch metric := i.(type) {
 		case metrics.Counter:
 			values[name] = strconv.FormatInt(metric.Count(), 10)
+			fields[name] = metric.Count()
 		case metrics.Gauge:
 			values[name] = strconv.FormatInt(metric.Value(), 10)
+			fields[name] = metric.Value()
+		case metrics.Timer:
+			s := metric.Snapshot()
+			ps := s.Percentiles([]float64{0.5, 0.99})
+			values[name] = fmt.Sprintf("count=%d,p50=%v,p99=%v,max=%v", s.Count(),
+				roundDuration(ps[0]), roundDuration(ps[1]), roundDuration(float64(s.Max())))
+			fields[name] = map[string]interface{}{
+				"count":       s.Count(),
+				"p50_seconds": roundDuration(ps[0]).Seconds(),
+				"p99_seconds": roundDuration(ps[1]).Seconds(),
+				"max_seconds": roundDuration(float64(s.Max())).Seconds(),
+			}
+		case metrics.Histogram:
+			s := metric.Snapshot()
+			ps := s.Percentiles([]float64{0.5, 0.99})
+			values[name] = fmt.Sprintf("count=%d,p50=%g,p99=%g,max=%d", s.Count(), ps[0], ps[1], s.Max())
+			fields[name] = map[string]interface{}{"count": s.Count(), "p50": ps[0], "p99": ps[1], "max": s.Max()}
 		default:
-			log.Fatalf("unknown metric type %v", metric)
+			unknown = append(unknown, fmt.Sprintf("%s (%T)", name, metric))
+			return
 		}
+		keys = append(keys, name)
 	})
 
-	var buffer bytes.Buffer
-	buffer.WriteString("metrics:")
+	if logJSON {
+		LogInfo("metrics", Fields{"metrics": fields}, "metrics snapshot")
+	} else {
+		var buffer bytes.Buffer
+		buffer.WriteString("metrics:")
 
-	sort.Strings(keys)
-	for _, k := range keys {
-		buffer.WriteString(fmt.Sprintf(" %s:%s", k, values[k]))
+		sort.Strings(keys)
+		for _, k := range keys {
+			buffer.WriteString(fmt.Sprintf(" %s:%s", k, values[k]))
+		}
+		LogInfo("metrics", nil, "%s", buffer.String())
 	}
 
-	log.Print(buffer.String())
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("unsupported metric types: %s", strings.Join(unknown, ", "))
+	}
+	return nil
 }
@@ -0,0 +1,140 @@
+// Copyright 2018 Sergey Grankin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s3util
+
+import (
+	"context"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/rcrowley/go-metrics"
+)
+
+var (
+	statUploadsListed  = metrics.NewRegisteredCounter("uploads_listed_total", nil)
+	statUploadsAborted = metrics.NewRegisteredCounter("uploads_aborted_total", nil)
+)
+
+// Upload is an in-progress multipart upload.
+type Upload struct {
+	Key       string
+	UploadId  string
+	Initiated time.Time
+}
+
+// ListMultipartUploads pages through the in-progress multipart uploads under
+// prefix, passing each non-empty page to out.  Errors are handled as in
+// ListObjectVersions.
+func (client *S3) ListMultipartUploads(
+	ctx context.Context,
+	bucket string, prefix string,
+	out func(uploads []Upload) error,
+) error {
+	var keyMarker, uploadIdMarker string
+	for {
+		input := &s3.ListMultipartUploadsInput{
+			Bucket: &bucket,
+			Prefix: &prefix,
+		}
+		if keyMarker != "" {
+			input.KeyMarker = aws.String(keyMarker)
+			input.UploadIdMarker = aws.String(uploadIdMarker)
+		}
+		page, err := client.listMultipartUploadsPage(ctx, input)
+		if err != nil {
+			return &ListError{
+				Bucket:         bucket,
+				Prefix:         prefix,
+				Uploads:        true,
+				KeyMarker:      keyMarker,
+				UploadIdMarker: uploadIdMarker,
+				Err:            err,
+			}
+		}
+
+		uploads := make([]Upload, 0, len(page.Uploads))
+		for _, up := range page.Uploads {
+			uploads = append(uploads, Upload{
+				Key:       aws.StringValue(up.Key),
+				UploadId:  aws.StringValue(up.UploadId),
+				Initiated: aws.TimeValue(up.Initiated),
+			})
+		}
+		statUploadsListed.Inc(int64(len(uploads)))
+
+		if len(uploads) > 0 {
+			if err := out(uploads); err != nil {
+				return err
+			}
+		}
+
+		if !aws.BoolValue(page.IsTruncated) {
+			return nil
+		}
+		keyMarker = aws.StringValue(page.NextKeyMarker)
+		uploadIdMarker = aws.StringValue(page.NextUploadIdMarker)
+	}
+}
+
+func (client *S3) listMultipartUploadsPage(
+	ctx context.Context, input *s3.ListMultipartUploadsInput,
+) (*s3.ListMultipartUploadsOutput, error) {
+	for attempt := 1; ; attempt++ {
+		if err := client.Limits.waitList(ctx, *input.Bucket, aws.StringValue(input.Prefix)); err != nil {
+			return nil, err
+		}
+		req := client.forBucket(*input.Bucket).ListMultipartUploadsRequest(input)
+		req.SetContext(ctx)
+		start := time.Now()
+		page, err := req.Send()
+		observeRequest("ListMultipartUploads", start, err)
+		if err != nil {
+			client.noteThrottle(errorCode(err))
+		}
+		if err == nil || !client.Retry.retryable(err) || !client.Retry.wait(ctx, attempt) {
+			return page, err
+		}
+	}
+}
+
+// AbortMultipartUpload aborts an upload, retrying according to the client's
+// retry policy.  An upload that no longer exists counts as aborted.
+func (client *S3) AbortMultipartUpload(ctx context.Context, bucket string, upload Upload) error {
+	for attempt := 1; ; attempt++ {
+		if err := client.Limits.waitDeletes(ctx, bucket, []string{upload.Key}); err != nil {
+			return &UploadError{Bucket: bucket, Upload: upload, Err: err}
+		}
+		req := client.forBucket(bucket).AbortMultipartUploadRequest(&s3.AbortMultipartUploadInput{
+			Bucket:   &bucket,
+			Key:      &upload.Key,
+			UploadId: &upload.UploadId,
+		})
+		req.SetContext(ctx)
+		start := time.Now()
+		_, err := req.Send()
+		observeRequest("AbortMultipartUpload", start, err)
+		client.noteDeleteRoundTrip(start)
+		if err == nil || errorCode(err) == s3.ErrCodeNoSuchUpload {
+			statUploadsAborted.Inc(1)
+			labeledCounter("uploads_aborted_total", "bucket", bucket).Inc(1)
+			return nil
+		}
+		client.noteThrottle(errorCode(err))
+		if !client.Retry.retryable(err) || !client.Retry.wait(ctx, attempt) {
+			return &UploadError{Bucket: bucket, Upload: upload, Err: err}
+		}
+	}
+}
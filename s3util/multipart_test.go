@@ -0,0 +1,61 @@
+// Copyright 2018 Sergey Grankin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s3util
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/sgrankin/s3-purge-bucket/s3util/s3test"
+)
+
+func TestMultipartUploads(t *testing.T) {
+	client, srv := newTestClient(t)
+	defer srv.Close()
+	initiated := time.Date(2018, 1, 2, 3, 4, 5, 0, time.UTC)
+	for i := 0; i < 7; i++ {
+		srv.CreateUpload("bucket", fmt.Sprintf("key%d", i%3), initiated)
+	}
+	srv.SetPageSize(2)
+	srv.Fail(s3test.OpListMultipartUploads, ErrCodeServiceUnavailable, 1)
+	srv.Fail(s3test.OpAbortMultipartUpload, ErrCodeInternalError, 1)
+
+	var uploads []Upload
+	err := client.ListMultipartUploads(context.Background(), "bucket", "", func(page []Upload) error {
+		uploads = append(uploads, page...)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(uploads) != 7 || !uploads[0].Initiated.Equal(initiated) {
+		t.Fatalf("listed %+v, want 7 uploads initiated at %v", uploads, initiated)
+	}
+
+	for _, up := range uploads {
+		if err := client.AbortMultipartUpload(context.Background(), "bucket", up); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if left := srv.Uploads("bucket"); len(left) != 0 {
+		t.Errorf("%d uploads left after aborting", len(left))
+	}
+	// Aborting again finds no upload, which counts as aborted.
+	if err := client.AbortMultipartUpload(context.Background(), "bucket", uploads[0]); err != nil {
+		t.Errorf("aborting an aborted upload: %v", err)
+	}
+}
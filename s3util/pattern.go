@@ -0,0 +1,136 @@
+// Copyright 2018 Sergey Grankin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s3util
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync/atomic"
+)
+
+// A KeyRule matches whole keys against a shell-style glob or, if the pattern
+// starts with "re:", an RE2 regular expression.  In globs, "*" and "?" do not
+// match "/", "**" matches anything, and "**/" matches zero or more
+// directories.  A KeyRule counts the keys it has matched and is safe for
+// concurrent use.
+type KeyRule struct {
+	Pattern string
+
+	re      *regexp.Regexp
+	matches int64
+}
+
+func NewKeyRule(pattern string) (*KeyRule, error) {
+	var expr string
+	if strings.HasPrefix(pattern, "re:") {
+		expr = strings.TrimPrefix(pattern, "re:")
+	} else {
+		expr = "^" + globToRegexp(pattern) + "$"
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern %q: %v", pattern, err)
+	}
+	return &KeyRule{Pattern: pattern, re: re}, nil
+}
+
+// Match reports whether key matches the rule.  Only the filters of Include
+// and Exclude count matches.
+func (r *KeyRule) Match(key string) bool {
+	return r.re.MatchString(key)
+}
+
+// Matches returns the number of keys matched so far by the filters of Include
+// and Exclude.
+func (r *KeyRule) Matches() int64 {
+	return atomic.LoadInt64(&r.matches)
+}
+
+// Include selects versions whose key matches any of the rules.  It counts
+// each key once, relying on seeing the versions of a key together, as they
+// are listed, so each listing needs its own.
+func Include(rules []*KeyRule) Filter {
+	return keyFilter(rules, true)
+}
+
+// Exclude selects versions whose key matches none of the rules.  Like
+// Include, each listing needs its own.
+func Exclude(rules []*KeyRule) Filter {
+	return keyFilter(rules, false)
+}
+
+// keyFilter matches the rules against each key the first time it is seen,
+// and selects its versions if that gives want.
+func keyFilter(rules []*KeyRule, want bool) Filter {
+	var key string
+	var seen, matched bool
+	return func(v *Version) bool {
+		if !seen || v.Key != key {
+			key, seen = v.Key, true
+			matched = countMatches(rules, key)
+		}
+		return matched == want
+	}
+}
+
+// countMatches reports whether any of the rules matches key.  It evaluates
+// every rule, rather than stopping at the first match, so that each rule's
+// count is accurate.
+func countMatches(rules []*KeyRule, key string) bool {
+	matched := false
+	for _, r := range rules {
+		if r.Match(key) {
+			atomic.AddInt64(&r.matches, 1)
+			matched = true
+		}
+	}
+	return matched
+}
+
+func globToRegexp(glob string) string {
+	var buf strings.Builder
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			if strings.HasPrefix(glob[i:], "**/") {
+				buf.WriteString("(?:.*/)?")
+				i += 2
+			} else if strings.HasPrefix(glob[i:], "**") {
+				buf.WriteString(".*")
+				i++
+			} else {
+				buf.WriteString("[^/]*")
+			}
+		case '?':
+			buf.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				buf.WriteString(regexp.QuoteMeta(glob[i:]))
+				return buf.String()
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			buf.WriteString("[" + strings.Replace(class, `\`, `\\`, -1) + "]")
+			i += end + 1
+		default:
+			buf.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return buf.String()
+}
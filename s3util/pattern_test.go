@@ -0,0 +1,47 @@
+// Copyright 2018 Sergey Grankin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s3util
+
+import "testing"
+
+func TestKeyRuleCounts(t *testing.T) {
+	include, err := NewKeyRule("**/*.tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exclude, err := NewKeyRule("keep/**")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := EachOf(Include([]*KeyRule{include}), Exclude([]*KeyRule{exclude}), DeleteMarkers)
+
+	got := f.Select([]Version{
+		{Key: "a.tmp"},
+		{Key: "a.tmp", DeleteMarker: true},
+		{Key: "keep/b.tmp", DeleteMarker: true},
+		{Key: "keep/c"},
+	})
+	if len(got) != 1 || got[0].Key != "a.tmp" || !got[0].DeleteMarker {
+		t.Errorf("selected %+v, want the a.tmp delete marker", got)
+	}
+	// Every key is matched against every rule once, whatever the other
+	// filters select.
+	if n := include.Matches(); n != 2 {
+		t.Errorf("include matched %d keys, want 2", n)
+	}
+	if n := exclude.Matches(); n != 2 {
+		t.Errorf("exclude matched %d keys, want 2", n)
+	}
+}
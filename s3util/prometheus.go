@@ -0,0 +1,142 @@
+// Copyright 2018 Sergey Grankin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s3util
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+// WritePrometheus writes every metric in registry in the Prometheus text
+// exposition format.  Counters named *_total are exposed as counters; other
+// counters, which go up and down, and gauges are exposed as gauges.  Timers
+// and histograms are exposed as summaries, with timers named *_seconds
+// converted from nanoseconds to seconds.  Series registered under labeled
+// names are grouped with their metric, whose unlabeled total is then left
+// out so that summing the series doesn't count everything twice.
+func WritePrometheus(w io.Writer, registry metrics.Registry) error {
+	type family struct {
+		kind      string
+		series    []string
+		unlabeled []string
+	}
+	families := make(map[string]*family)
+	add := func(base, kind string, labeled bool, series string) {
+		f := families[base]
+		if f == nil {
+			f = &family{kind: kind}
+			families[base] = f
+		}
+		if labeled {
+			f.series = append(f.series, series)
+		} else {
+			f.unlabeled = append(f.unlabeled, series)
+		}
+	}
+	summary := func(name string, count int64, sum float64, quantiles []float64, scale float64) {
+		base, labels := splitLabels(name)
+		labeled := labels != ""
+		for i, q := range quantiles {
+			series := base + withLabel(labels, "quantile", strconv.FormatFloat(summaryQuantiles[i], 'g', -1, 64))
+			add(base, "summary", labeled, fmt.Sprintf("%s %g", series, q*scale))
+		}
+		add(base, "summary", labeled, fmt.Sprintf("%s_sum%s %g", base, labels, sum*scale))
+		add(base, "summary", labeled, fmt.Sprintf("%s_count%s %d", base, labels, count))
+	}
+
+	registry.Each(func(name string, i interface{}) {
+		base, labels := splitLabels(name)
+		labeled := labels != ""
+		switch metric := i.(type) {
+		case metrics.Counter:
+			kind := "gauge"
+			if strings.HasSuffix(base, "_total") {
+				kind = "counter"
+			}
+			add(base, kind, labeled, fmt.Sprintf("%s %d", name, metric.Count()))
+		case metrics.Gauge:
+			add(base, "gauge", labeled, fmt.Sprintf("%s %d", name, metric.Value()))
+		case metrics.Timer:
+			s := metric.Snapshot()
+			scale := 1.0
+			if strings.HasSuffix(base, "_seconds") {
+				scale = float64(time.Nanosecond) / float64(time.Second)
+			}
+			summary(name, s.Count(), float64(s.Sum()), s.Percentiles(summaryQuantiles), scale)
+		case metrics.Histogram:
+			s := metric.Snapshot()
+			summary(name, s.Count(), float64(s.Sum()), s.Percentiles(summaryQuantiles), 1)
+		}
+	})
+
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	bw := bufio.NewWriter(w)
+	for _, name := range names {
+		f := families[name]
+		if len(f.series) == 0 {
+			f.series = f.unlabeled
+		}
+		sort.Strings(f.series)
+		fmt.Fprintf(bw, "# TYPE %s %s\n", name, f.kind)
+		for _, series := range f.series {
+			fmt.Fprintln(bw, series)
+		}
+	}
+	return bw.Flush()
+}
+
+// summaryQuantiles are the quantiles reported for timers and histograms.
+var summaryQuantiles = []float64{0.5, 0.9, 0.99}
+
+// splitLabels splits a labeled name into the metric name and its labels,
+// e.g. requests_total and {op="x"}.
+func splitLabels(name string) (base, labels string) {
+	if i := strings.IndexByte(name, '{'); i >= 0 {
+		return name[:i], name[i:]
+	}
+	return name, ""
+}
+
+// withLabel adds the label name=value to labels as returned by splitLabels.
+func withLabel(labels, name, value string) string {
+	label := name + `="` + labelEscaper.Replace(value) + `"`
+	if labels == "" || labels == "{}" {
+		return "{" + label + "}"
+	}
+	return labels[:len(labels)-1] + "," + label + "}"
+}
+
+// MetricsHandler serves the default registry for Prometheus to scrape.
+func MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		if err := WritePrometheus(w, metrics.DefaultRegistry); err != nil {
+			LogError("metrics_failed", Fields{"error": err}, "serving metrics: %v", err)
+		}
+	})
+}
@@ -0,0 +1,96 @@
+// Copyright 2018 Sergey Grankin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s3util
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+func TestWritePrometheus(t *testing.T) {
+	registry := metrics.NewRegistry()
+	metrics.NewRegisteredCounter("objs_deleted_total", registry).Inc(5)
+	metrics.NewRegisteredCounter(labeledName("objs_deleted_total", "bucket", "b"), registry).Inc(3)
+	metrics.NewRegisteredCounter(labeledName("objs_deleted_total", "bucket", `a"\`), registry).Inc(2)
+	metrics.NewRegisteredCounter("deletes_pending", registry).Inc(1)
+	metrics.NewRegisteredGauge("concurrency_limit", registry).Update(64)
+
+	var buf bytes.Buffer
+	if err := WritePrometheus(&buf, registry); err != nil {
+		t.Fatal(err)
+	}
+	want := `# TYPE concurrency_limit gauge
+concurrency_limit 64
+# TYPE deletes_pending gauge
+deletes_pending 1
+# TYPE objs_deleted_total counter
+objs_deleted_total{bucket="a\"\\"} 2
+objs_deleted_total{bucket="b"} 3
+`
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestWritePrometheusSummaries(t *testing.T) {
+	registry := metrics.NewRegistry()
+	timer := metrics.NewCustomTimer(metrics.NewHistogram(metrics.NewUniformSample(100)), metrics.NewMeter())
+	registry.Register(labeledName("request_duration_seconds", "op", "DeleteObjects"), timer)
+	timer.Update(time.Second)
+	timer.Update(3 * time.Second)
+	histogram := metrics.NewRegisteredHistogram("delete_batch_size", registry, metrics.NewUniformSample(100))
+	for i := int64(1); i <= 4; i++ {
+		histogram.Update(i)
+	}
+
+	var buf bytes.Buffer
+	if err := WritePrometheus(&buf, registry); err != nil {
+		t.Fatal(err)
+	}
+	want := `# TYPE delete_batch_size summary
+delete_batch_size_count 4
+delete_batch_size_sum 10
+delete_batch_size{quantile="0.5"} 2.5
+delete_batch_size{quantile="0.9"} 4
+delete_batch_size{quantile="0.99"} 4
+# TYPE request_duration_seconds summary
+request_duration_seconds_count{op="DeleteObjects"} 2
+request_duration_seconds_sum{op="DeleteObjects"} 4
+request_duration_seconds{op="DeleteObjects",quantile="0.5"} 2
+request_duration_seconds{op="DeleteObjects",quantile="0.9"} 3
+request_duration_seconds{op="DeleteObjects",quantile="0.99"} 3
+`
+	if got := buf.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestLogMetricsSkipsLabeled(t *testing.T) {
+	labeledCounter("objs_deleted_total", "bucket", "b").Inc(1)
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	LogMetrics()
+	if got := buf.String(); !strings.Contains(got, " objs_deleted_total:") || strings.Contains(got, "{") {
+		t.Errorf("logged %q, want the totals without labeled series", got)
+	}
+}
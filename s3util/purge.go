@@ -0,0 +1,471 @@
+// Copyright 2018 Sergey Grankin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s3util
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+var (
+	statObjsQueued   = metrics.NewRegisteredCounter("objs_queued", nil)
+	statBytesDeleted = metrics.NewRegisteredCounter("bytes_deleted_total", nil)
+)
+
+// Target is a bucket, or a prefix of one, to purge.
+type Target struct {
+	Bucket string
+	Prefix string
+}
+
+// PurgeOptions configures a Purger.  Zero values select the defaults noted.
+type PurgeOptions struct {
+	Store ObjectStore
+
+	// Controller limits concurrent deletes and upload aborts.  Wire its
+	// Throttled method to S3.OnThrottle for it to back off on throttling,
+	// and its Observe method to S3.OnDeleteRoundTrip for it to back off on
+	// rising latency.
+	// Defaults to NewController(64, 4, 512).
+	Controller *Controller
+	Listers    int // concurrent listers; defaults to 16
+
+	DryRun bool // list and select, but skip deletes, aborts and bucket removal
+
+	// NewFilter returns the filter for the versions listed by one lister; nil
+	// selects everything.  Filters may be stateful, and each lister gets its own.
+	NewFilter func() Filter
+	// ExpiredDeleteMarkers only selects delete markers that are the only
+	// remaining version of their key, among those NewFilter selects.
+	ExpiredDeleteMarkers bool
+
+	SkipObjects            bool                  // leave objects alone, e.g. to only abort uploads
+	AbortUploads           bool                  // abort multipart uploads under the targets
+	UploadsInitiatedBefore time.Time             // only abort uploads initiated before this, if set
+	UploadKeys             func(key string) bool // only abort uploads whose key this selects, if set
+	RemoveBuckets          bool                  // remove the buckets once the purge completes
+
+	Checkpoint         string        // periodically save progress to this file
+	CheckpointInterval time.Duration // defaults to 30s
+	Resume             *Checkpoint   // progress to resume from
+
+	// DrainTimeout is how long deletes in flight may finish once the context
+	// of Purge is done; they are then cancelled.
+	DrainTimeout time.Duration
+
+	// OnEvent, if set, is called with progress events.  It is called
+	// concurrently and should return quickly.
+	OnEvent func(Event)
+}
+
+// EventKind identifies a progress event.
+type EventKind int
+
+const (
+	EventPageListed    EventKind = iota + 1 // Count versions were listed, of which Selected were queued
+	EventBatchDeleted                       // Count versions of Bytes total size were deleted
+	EventUploadAborted                      // an upload was aborted
+	EventRangeListed                        // a lister finished its key range
+	EventBucketRemoved                      // the bucket was removed
+)
+
+// Event is a progress event of a purge.
+type Event struct {
+	Kind     EventKind
+	Bucket   string
+	Prefix   string
+	Count    int
+	Selected int
+	Bytes    int64
+
+	// Fraction estimates how much of the target's key space has been
+	// listed, for EventPageListed and EventRangeListed.
+	Fraction float64
+}
+
+// PurgeResult summarizes a purge.
+type PurgeResult struct {
+	// Completed is set if every target was fully listed and every selected
+	// version deleted, i.e. the purge was neither cancelled nor failed.
+	Completed bool
+
+	Listed         int64            // versions and delete markers listed
+	Deleted        int64            // versions and delete markers deleted, or selected in a dry run
+	DeletedBytes   map[string]int64 // size of the Deleted versions, by storage class
+	UploadsAborted int64
+	RemovedBuckets []string
+
+	// Checkpoint is the final progress of every key range.
+	Checkpoint *Checkpoint
+}
+
+// Purger deletes object versions, delete markers and multipart uploads from
+// a store, listing in parallel and deleting as fast as the store allows.
+type Purger struct {
+	opts PurgeOptions
+}
+
+func NewPurger(opts PurgeOptions) *Purger {
+	if opts.Controller == nil {
+		opts.Controller = NewController(64, 4, 512)
+	}
+	if opts.Listers <= 0 {
+		opts.Listers = 16
+	}
+	if opts.CheckpointInterval <= 0 {
+		opts.CheckpointInterval = 30 * time.Second
+	}
+	return &Purger{opts: opts}
+}
+
+// deleteRequest is a batch of selected versions from one listed page.
+type deleteRequest struct {
+	bucket   string
+	prefix   string
+	versions []Version
+	page     *pageProgress
+}
+
+// purge is the state of a single Purge call.
+type purge struct {
+	*Purger
+
+	// stopping is done when the context of Purge is, or on failure: listers
+	// stop fetching pages and deleters stop picking up new batches.  aborted
+	// is done DrainTimeout later, or on failure, and cancels deletes in flight.
+	stopping context.Context
+	aborted  context.Context
+	fail     func(error)
+
+	progress *tracker
+	queue    chan *deleteRequest
+
+	mu     sync.Mutex
+	err    error
+	result PurgeResult
+}
+
+// Purge deletes the selected versions under the targets, and then the
+// buckets if so configured.  It returns early, with an incomplete result, if
+// ctx is done; and on the first error, which it returns along with the result
+// so far.
+func (p *Purger) Purge(ctx context.Context, targets []Target) (*PurgeResult, error) {
+	stopping, stop := context.WithCancel(ctx)
+	defer stop()
+	aborted, abort := context.WithCancel(context.Background())
+	defer abort()
+	go func() {
+		<-stopping.Done()
+		if ctx.Err() != nil {
+			time.AfterFunc(p.opts.DrainTimeout, abort)
+		}
+	}()
+
+	r := &purge{
+		Purger:   p,
+		stopping: stopping,
+		aborted:  aborted,
+		progress: &tracker{},
+		queue:    make(chan *deleteRequest, p.opts.Controller.Max),
+		result:   PurgeResult{DeletedBytes: make(map[string]int64)},
+	}
+	r.fail = func(err error) {
+		r.mu.Lock()
+		if r.err == nil {
+			r.err = err
+		}
+		r.mu.Unlock()
+		stop()
+		abort()
+	}
+	r.run(targets)
+
+	r.result.Checkpoint = r.progress.snapshot()
+	return &r.result, r.err
+}
+
+func (r *purge) run(targets []Target) {
+	if r.opts.Checkpoint != "" {
+		done := make(chan struct{})
+		defer close(done)
+		go r.progress.saveEvery(r.opts.Checkpoint, r.opts.CheckpointInterval, done)
+	}
+
+	var listers, deleters, uploaders sync.WaitGroup
+	pool := newShardPool(r.stopping, r.progress)
+	buckets := make(map[string]bool)
+	for _, t := range targets {
+		buckets[t.Bucket] = true
+		if !r.opts.SkipObjects {
+			pool.seed(r.stopping, r.opts.Store, t, r.opts.Resume)
+		}
+		if r.opts.AbortUploads {
+			uploaders.Add(1)
+			go func(t Target) {
+				defer uploaders.Done()
+				r.uploadLister(t)
+			}(t)
+		}
+	}
+
+	for i := 0; i < r.opts.Listers; i++ {
+		listers.Add(1)
+		go func() {
+			defer listers.Done()
+			for lp := pool.take(); lp != nil; lp = pool.take() {
+				r.lister(lp)
+				pool.done(lp)
+			}
+		}()
+	}
+
+	for i := 0; i < r.opts.Controller.Max; i++ {
+		deleters.Add(1)
+		go func() {
+			defer deleters.Done()
+			r.deleter()
+		}()
+	}
+
+	listers.Wait()
+	close(r.queue)
+	deleters.Wait()
+	uploaders.Wait()
+
+	if r.opts.Checkpoint != "" {
+		if err := r.progress.save(r.opts.Checkpoint); err != nil {
+			LogError("checkpoint_failed", Fields{"path": r.opts.Checkpoint, "error": err}, "saving checkpoint: %v", err)
+		}
+	}
+
+	if r.stopping.Err() != nil {
+		return
+	}
+	r.result.Completed = true
+
+	if !r.opts.RemoveBuckets || r.opts.DryRun {
+		return
+	}
+	names := make([]string, 0, len(buckets))
+	for bucket := range buckets {
+		names = append(names, bucket)
+	}
+	sort.Strings(names)
+	for _, bucket := range names {
+		LogInfo("bucket_removing", Fields{"bucket": bucket}, "removing bucket %s", bucket)
+		if err := r.opts.Store.DeleteBucket(r.aborted, bucket); err != nil {
+			r.result.Completed = false
+			r.fail(err)
+			return
+		}
+		r.result.RemovedBuckets = append(r.result.RemovedBuckets, bucket)
+		r.emit(Event{Kind: EventBucketRemoved, Bucket: bucket})
+	}
+}
+
+func (r *purge) emit(e Event) {
+	if r.opts.OnEvent != nil {
+		r.opts.OnEvent(e)
+	}
+}
+
+// intersectVersions returns the versions in a that are also in b.
+func intersectVersions(a, b []Version) []Version {
+	type id struct{ key, versionId string }
+	in := make(map[id]bool, len(b))
+	for _, v := range b {
+		in[id{v.Key, v.VersionId}] = true
+	}
+	var both []Version
+	for _, v := range a {
+		if in[id{v.Key, v.VersionId}] {
+			both = append(both, v)
+		}
+	}
+	return both
+}
+
+// errRangeDone stops a listing that has passed the end of its key range.
+var errRangeDone = errors.New("end of key range")
+
+// lister lists the key range of lp and queues the selected versions for
+// deletion.  The range may be split while it runs, so its end is checked on
+// every page.
+func (r *purge) lister(lp *listerProgress) {
+	ctx := r.stopping
+	bucket, prefix := lp.state.Bucket, lp.state.Prefix
+	start := lp.start()
+
+	var filter Filter
+	if r.opts.NewFilter != nil {
+		filter = r.opts.NewFilter()
+	}
+
+	LogDebug("range_listing", Fields{"bucket": bucket, "prefix": prefix, "from": start.KeyMarker, "to": lp.end()},
+		"listing %s/%s from %q to %q", bucket, prefix, start.KeyMarker, lp.end())
+	err := r.opts.Store.ListObjectVersions(ctx, bucket, prefix, start, func(page *Page) error {
+		var done error
+		if page = lp.claim(page); page.Last {
+			done = errRangeDone
+		}
+
+		// The filter sees the whole page, as stateful filters and key rule
+		// counts expect, even when expired delete markers narrow it.
+		versions := filter.Select(page.Versions)
+		if r.opts.ExpiredDeleteMarkers {
+			expired, err := ExpiredDeleteMarkers(ctx, r.opts.Store, bucket, page)
+			if err != nil {
+				return err
+			}
+			versions = intersectVersions(versions, expired)
+		}
+
+		r.mu.Lock()
+		r.result.Listed += int64(len(page.Versions))
+		r.mu.Unlock()
+
+		p := lp.addPage(page, len(versions))
+		r.emit(Event{Kind: EventPageListed, Bucket: bucket, Prefix: prefix,
+			Count: len(page.Versions), Selected: len(versions),
+			Fraction: r.progress.listedFraction(bucket, prefix)})
+		if len(versions) == 0 {
+			p.ack()
+			return done
+		}
+		statObjsQueued.Inc(int64(len(versions)))
+		r.queue <- &deleteRequest{
+			bucket:   bucket,
+			prefix:   prefix,
+			versions: versions,
+			page:     p,
+		}
+		return done
+	})
+	if err != nil && err != errRangeDone {
+		if ctx.Err() != nil {
+			LogDebug("range_stopped", Fields{"bucket": bucket, "prefix": prefix}, "stopped listing %s/%s", bucket, prefix)
+			return
+		}
+		r.fail(err)
+		return
+	}
+	LogDebug("range_listed", Fields{"bucket": bucket, "prefix": prefix, "to": lp.end()},
+		"finished listing %s/%s to %q", bucket, prefix, lp.end())
+	r.emit(Event{Kind: EventRangeListed, Bucket: bucket, Prefix: prefix,
+		Fraction: r.progress.listedFraction(bucket, prefix)})
+}
+
+// deleter deletes queued batches until the queue is closed, sending no more
+// concurrently than the controller allows.  Once the purge is stopping,
+// remaining batches are dropped without acking their pages, so that the
+// checkpoint does not advance past them.
+func (r *purge) deleter() {
+	controller := r.opts.Controller
+	for req := range r.queue {
+		statObjsQueued.Dec(int64(len(req.versions)))
+		if r.stopping.Err() != nil {
+			continue
+		}
+		if !r.opts.DryRun {
+			controller.Acquire()
+			err := r.opts.Store.DeleteObjectVersions(r.aborted, req.bucket, req.versions)
+			controller.Release(len(req.versions))
+			if err != nil {
+				if r.aborted.Err() != nil {
+					LogInfo("delete_abandoned", Fields{"bucket": req.bucket, "prefix": req.prefix, "count": len(req.versions), "error": err},
+						"abandoned in-flight delete: %v", err)
+					continue
+				}
+				r.fail(err)
+				continue
+			}
+		}
+
+		var bytes int64
+		r.mu.Lock()
+		for i := range req.versions {
+			if v := &req.versions[i]; !v.DeleteMarker {
+				r.result.DeletedBytes[v.StorageClass] += v.Size
+				bytes += v.Size
+			}
+		}
+		r.result.Deleted += int64(len(req.versions))
+		r.mu.Unlock()
+		statBytesDeleted.Inc(bytes)
+		labeledCounter("bytes_deleted_total", "bucket", req.bucket).Inc(bytes)
+		r.emit(Event{Kind: EventBatchDeleted, Bucket: req.bucket, Prefix: req.prefix,
+			Count: len(req.versions), Bytes: bytes})
+
+		req.page.ack()
+	}
+}
+
+// uploadLister aborts the multipart uploads under a target, sharing the
+// delete concurrency budget with the deleters.
+func (r *purge) uploadLister(t Target) {
+	LogDebug("uploads_listing", Fields{"bucket": t.Bucket, "prefix": t.Prefix}, "listing uploads in %s/%s", t.Bucket, t.Prefix)
+
+	controller := r.opts.Controller
+	cutoff := r.opts.UploadsInitiatedBefore
+	var aborts sync.WaitGroup
+	err := r.opts.Store.ListMultipartUploads(r.stopping, t.Bucket, t.Prefix, func(uploads []Upload) error {
+		for _, up := range uploads {
+			if !cutoff.IsZero() && !up.Initiated.Before(cutoff) {
+				continue
+			}
+			if r.opts.UploadKeys != nil && !r.opts.UploadKeys(up.Key) {
+				continue
+			}
+			if r.opts.DryRun || r.stopping.Err() != nil {
+				continue
+			}
+
+			controller.Acquire()
+			aborts.Add(1)
+			go func(up Upload) {
+				defer aborts.Done()
+				err := r.opts.Store.AbortMultipartUpload(r.aborted, t.Bucket, up)
+				controller.Release(1)
+				if err != nil {
+					if r.aborted.Err() == nil {
+						r.fail(err)
+					}
+					return
+				}
+				r.mu.Lock()
+				r.result.UploadsAborted++
+				r.mu.Unlock()
+				r.emit(Event{Kind: EventUploadAborted, Bucket: t.Bucket, Prefix: t.Prefix, Count: 1})
+			}(up)
+		}
+		return nil
+	})
+	aborts.Wait()
+
+	if err != nil {
+		if r.stopping.Err() != nil {
+			LogDebug("uploads_stopped", Fields{"bucket": t.Bucket, "prefix": t.Prefix}, "stopped listing uploads in %s/%s", t.Bucket, t.Prefix)
+			return
+		}
+		r.fail(err)
+		return
+	}
+	LogDebug("uploads_listed", Fields{"bucket": t.Bucket, "prefix": t.Prefix}, "finished listing uploads in %s/%s", t.Bucket, t.Prefix)
+}
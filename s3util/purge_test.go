@@ -0,0 +1,434 @@
+// Copyright 2018 Sergey Grankin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s3util
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sgrankin/s3-purge-bucket/s3util/s3test"
+)
+
+// newPurgeFake returns a fake S3 holding the buckets, each filled with
+// versions, delete markers and multipart uploads, and options to purge them.
+func newPurgeFake(t *testing.T, buckets ...string) (*s3test.Server, PurgeOptions) {
+	srv := s3test.NewServer()
+	for _, bucket := range buckets {
+		srv.CreateBucket(bucket, "us-east-1")
+		for i := 0; i < 300; i++ {
+			key := fmt.Sprintf("%c/%04d", 'a'+i%5, i)
+			for j := 0; j <= i%3; j++ {
+				srv.Put(bucket, s3test.Object{Key: key, Size: 100})
+			}
+			if i%7 == 0 {
+				srv.Put(bucket, s3test.Object{Key: key, DeleteMarker: true})
+			}
+		}
+		for i := 0; i < 5; i++ {
+			srv.CreateUpload(bucket, fmt.Sprintf("upload/%d", i), time.Now())
+		}
+	}
+	srv.SetPageSize(17)
+
+	client, err := NewClient("us-east-1", Endpoint{URL: srv.URL, PathStyle: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Retry.BaseDelay = time.Millisecond
+	client.Retry.MaxDelay = 5 * time.Millisecond
+	controller := NewController(8, 2, 16)
+	client.OnThrottle = controller.Throttled
+	client.OnDeleteRoundTrip = controller.Observe
+	return srv, PurgeOptions{
+		Store:         client,
+		Controller:    controller,
+		AbortUploads:  true,
+		RemoveBuckets: true,
+	}
+}
+
+func TestPurge(t *testing.T) {
+	srv, opts := newPurgeFake(t, "one", "two")
+	defer srv.Close()
+	srv.Fail(s3test.OpListObjectVersions, ErrCodeInternalError, 3)
+	srv.Fail(s3test.OpDeleteObjects, ErrCodeSlowDown, 3)
+	srv.Fail(s3test.OpAbortMultipartUpload, ErrCodeInternalError, 2)
+	srv.FailKeys(ErrCodeSlowDown, 25)
+	want := int64(len(srv.Versions("one")) + len(srv.Versions("two")))
+
+	var mu sync.Mutex
+	events := make(map[EventKind]int)
+	opts.OnEvent = func(e Event) {
+		mu.Lock()
+		events[e.Kind] += e.Count
+		mu.Unlock()
+	}
+
+	targets := []Target{{Bucket: "one"}, {Bucket: "two", Prefix: "a/"}, {Bucket: "two"}}
+	result, err := NewPurger(opts).Purge(context.Background(), targets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Completed {
+		t.Fatal("purge did not complete")
+	}
+	for _, bucket := range []string{"one", "two"} {
+		if srv.HasBucket(bucket) {
+			t.Errorf("bucket %s was not removed; %d versions and %d uploads left",
+				bucket, len(srv.Versions(bucket)), len(srv.Uploads(bucket)))
+		}
+	}
+
+	// The prefix a/ of bucket two is purged twice, so some versions may be
+	// listed and deleted twice.
+	if result.Deleted < want || result.Listed < result.Deleted {
+		t.Errorf("listed %d and deleted %d versions, want at least %d", result.Listed, result.Deleted, want)
+	}
+	if int64(events[EventBatchDeleted]) != result.Deleted || int64(events[EventPageListed]) != result.Listed {
+		t.Errorf("events counted %d listed and %d deleted, result %d and %d",
+			events[EventPageListed], events[EventBatchDeleted], result.Listed, result.Deleted)
+	}
+	if result.UploadsAborted < 10 || result.DeletedBytes["STANDARD"] == 0 {
+		t.Errorf("aborted %d uploads and deleted %v, want at least 10 uploads and some bytes",
+			result.UploadsAborted, result.DeletedBytes)
+	}
+	if len(result.RemovedBuckets) != 2 {
+		t.Errorf("removed buckets %q, want both", result.RemovedBuckets)
+	}
+}
+
+func TestPurgeFiltered(t *testing.T) {
+	srv, opts := newPurgeFake(t, "bucket")
+	defer srv.Close()
+	opts.NewFilter = func() Filter { return Noncurrent }
+	opts.AbortUploads = false
+	opts.RemoveBuckets = false
+
+	result, err := NewPurger(opts).Purge(context.Background(), []Target{{Bucket: "bucket"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Completed {
+		t.Fatal("purge did not complete")
+	}
+	if !srv.HasBucket("bucket") {
+		t.Fatal("bucket was removed despite the filter")
+	}
+	for _, v := range srv.Versions("bucket") {
+		if !v.IsLatest {
+			t.Errorf("noncurrent version %s of %s was not deleted", v.VersionId, v.Key)
+		}
+	}
+	if n := len(srv.Versions("bucket")); n != 300 {
+		t.Errorf("%d versions left, want the latest of each of 300 keys", n)
+	}
+	if n := len(srv.Uploads("bucket")); n != 5 {
+		t.Errorf("%d uploads left, want all 5 kept", n)
+	}
+}
+
+func TestPurgeDeletedBytes(t *testing.T) {
+	srv := s3test.NewServer()
+	defer srv.Close()
+	srv.CreateBucket("bucket", "us-east-1")
+	srv.Put("bucket", s3test.Object{Key: "a", Size: 100})
+	srv.Put("bucket", s3test.Object{Key: "a", Size: 200, StorageClass: "GLACIER"})
+	srv.Put("bucket", s3test.Object{Key: "b", Size: 5, StorageClass: "GLACIER"})
+	srv.Put("bucket", s3test.Object{Key: "c", Size: 7, StorageClass: "DEEP_ARCHIVE"})
+	srv.Put("bucket", s3test.Object{Key: "c", DeleteMarker: true})
+	client, err := NewClient("us-east-1", Endpoint{URL: srv.URL, PathStyle: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := PurgeOptions{Store: client, NewFilter: func() Filter { return StorageClasses("GLACIER", "STANDARD") }}
+	result, err := NewPurger(opts).Purge(context.Background(), []Target{{Bucket: "bucket"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int64{"STANDARD": 100, "GLACIER": 205}
+	if !reflect.DeepEqual(result.DeletedBytes, want) {
+		t.Errorf("deleted bytes %v, want %v", result.DeletedBytes, want)
+	}
+	if result.Deleted != 3 {
+		t.Errorf("deleted %d versions, want 3", result.Deleted)
+	}
+}
+
+func TestPurgeKeyRuleCounts(t *testing.T) {
+	srv, opts := newPurgeFake(t, "bucket")
+	defer srv.Close()
+	rule, err := NewKeyRule("a/**")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts.NewFilter = func() Filter { return Include([]*KeyRule{rule}) }
+	opts.ExpiredDeleteMarkers = true
+	opts.AbortUploads = false
+	opts.RemoveBuckets = false
+
+	if _, err := NewPurger(opts).Purge(context.Background(), []Target{{Bucket: "bucket"}}); err != nil {
+		t.Fatal(err)
+	}
+	// Every key under a/ counts once, although it has several versions and
+	// none is an expired delete marker.
+	if n := rule.Matches(); n != 60 {
+		t.Errorf("rule matched %d keys, want 60", n)
+	}
+	if n := len(srv.Versions("bucket")); n == 0 {
+		t.Error("deleted everything")
+	}
+}
+
+func TestPurgeUploadKeys(t *testing.T) {
+	srv, opts := newPurgeFake(t, "bucket")
+	defer srv.Close()
+	opts.SkipObjects = true
+	opts.RemoveBuckets = false
+	opts.UploadKeys = func(key string) bool { return key != "upload/3" }
+
+	result, err := NewPurger(opts).Purge(context.Background(), []Target{{Bucket: "bucket"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.UploadsAborted != 4 {
+		t.Errorf("aborted %d uploads, want 4", result.UploadsAborted)
+	}
+	if left := srv.Uploads("bucket"); len(left) != 1 || left[0].Key != "upload/3" {
+		t.Errorf("uploads left %+v, want only upload/3", left)
+	}
+}
+
+func TestPurgeCancelled(t *testing.T) {
+	srv, opts := newPurgeFake(t, "bucket")
+	defer srv.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	result, err := NewPurger(opts).Purge(ctx, []Target{{Bucket: "bucket"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Completed {
+		t.Fatal("cancelled purge reported completion")
+	}
+	if !srv.HasBucket("bucket") {
+		t.Error("bucket was removed after cancellation")
+	}
+}
+
+func TestPurgeFailure(t *testing.T) {
+	srv, opts := newPurgeFake(t, "bucket")
+	defer srv.Close()
+	srv.FailKeys("AccessDenied", 1)
+
+	result, err := NewPurger(opts).Purge(context.Background(), []Target{{Bucket: "bucket"}})
+	if _, ok := err.(*DeleteError); !ok {
+		t.Fatalf("got error %v, want a *DeleteError", err)
+	}
+	if result.Completed || !srv.HasBucket("bucket") {
+		t.Error("failed purge completed")
+	}
+}
+
+// memStore is a minimal ObjectStore holding a single bucket in memory.
+type memStore struct {
+	mu       sync.Mutex
+	versions []Version // in listing order
+	removed  bool
+}
+
+func (m *memStore) ListObjectVersions(
+	ctx context.Context, bucket, prefix string, start Marker, out func(*Page) error,
+) error {
+	const pageSize = 10
+	m.mu.Lock()
+	var page []Version
+	for _, v := range m.versions {
+		if v.Key > start.KeyMarker || v.Key == start.KeyMarker && v.VersionId > start.VersionIdMarker {
+			page = append(page, v)
+		}
+	}
+	m.mu.Unlock()
+
+	last := len(page) <= pageSize
+	if !last {
+		page = page[:pageSize]
+	}
+	next := Marker{}
+	if n := len(page); n > 0 {
+		next = Marker{KeyMarker: page[n-1].Key, VersionIdMarker: page[n-1].VersionId}
+	}
+	if err := out(&Page{Versions: page, Next: next, Last: last}); err != nil || last {
+		return err
+	}
+	return m.ListObjectVersions(ctx, bucket, prefix, next, out)
+}
+
+func (m *memStore) DeleteObjectVersions(ctx context.Context, bucket string, versions []Version) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	deleted := make(map[Version]bool)
+	for _, v := range versions {
+		deleted[v] = true
+	}
+	left := m.versions[:0]
+	for _, v := range m.versions {
+		if !deleted[v] {
+			left = append(left, v)
+		}
+	}
+	m.versions = left
+	return nil
+}
+
+func (m *memStore) DeleteBucket(ctx context.Context, bucket string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.versions) > 0 {
+		return fmt.Errorf("bucket %s not empty", bucket)
+	}
+	m.removed = true
+	return nil
+}
+
+func (m *memStore) ListMultipartUploads(context.Context, string, string, func([]Upload) error) error {
+	return nil
+}
+
+func (m *memStore) AbortMultipartUpload(context.Context, string, Upload) error {
+	return nil
+}
+
+func TestPurgeStore(t *testing.T) {
+	m := &memStore{}
+	for i := 0; i < 95; i++ {
+		m.versions = append(m.versions, Version{Key: fmt.Sprintf("key%03d", i/2), VersionId: fmt.Sprint(i % 2)})
+	}
+
+	result, err := NewPurger(PurgeOptions{Store: m, RemoveBuckets: true}).Purge(context.Background(), []Target{{Bucket: "bucket"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Completed || len(m.versions) != 0 || !m.removed {
+		t.Errorf("%d versions left; bucket removed: %v", len(m.versions), m.removed)
+	}
+}
+
+// flatStore is a memStore that is slow to list, and records how many
+// listings run at once.
+type flatStore struct {
+	*memStore
+	mu        sync.Mutex
+	active    int
+	maxActive int
+}
+
+func (f *flatStore) ListObjectVersions(
+	ctx context.Context, bucket, prefix string, start Marker, out func(*Page) error,
+) error {
+	f.mu.Lock()
+	f.active++
+	if f.active > f.maxActive {
+		f.maxActive = f.active
+	}
+	f.mu.Unlock()
+	defer func() {
+		f.mu.Lock()
+		f.active--
+		f.mu.Unlock()
+	}()
+	return f.memStore.ListObjectVersions(ctx, bucket, prefix, start, func(page *Page) error {
+		time.Sleep(time.Millisecond)
+		return out(page)
+	})
+}
+
+func TestPurgeSplitsFlatKeySpace(t *testing.T) {
+	f := &flatStore{memStore: &memStore{}}
+	for i := 0; i < 2000; i++ {
+		f.versions = append(f.versions, Version{Key: fmt.Sprintf("key%05d", i), VersionId: "1"})
+	}
+
+	result, err := NewPurger(PurgeOptions{Store: f, Listers: 8}).Purge(context.Background(), []Target{{Bucket: "bucket"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Completed || len(f.versions) != 0 {
+		t.Fatalf("%d versions left", len(f.versions))
+	}
+	if f.maxActive < 4 {
+		t.Errorf("at most %d listers ran at once, want the key space split among at least 4", f.maxActive)
+	}
+	if n := len(result.Checkpoint.Listers); n < 4 {
+		t.Errorf("listed %d key ranges, want at least 4", n)
+	}
+}
+
+func TestPurgeSplitsRanges(t *testing.T) {
+	srv, opts := newPurgeFake(t, "bucket")
+	defer srv.Close()
+	for i := 0; i < 300; i++ {
+		srv.Put("bucket", s3test.Object{Key: fmt.Sprintf("flat%04d", i)})
+	}
+	opts.Listers = 8
+
+	result, err := NewPurger(opts).Purge(context.Background(), []Target{{Bucket: "bucket"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Completed || srv.HasBucket("bucket") {
+		t.Fatal("purge did not complete")
+	}
+	// The prefixes a/ to e/ are seeded as ranges, and the flat keys after
+	// them are split among the idle listers.
+	if n := len(result.Checkpoint.Listers); n <= 6 {
+		t.Errorf("listed %d key ranges, want the last one split", n)
+	}
+}
+
+func TestPurgeResumesRanges(t *testing.T) {
+	srv, opts := newPurgeFake(t, "bucket")
+	defer srv.Close()
+	opts.AbortUploads = false
+	opts.RemoveBuckets = false
+	// The ranges start at keys alone, as split and seeded ranges do; "a/" to
+	// "c/" is done and must not be listed again.
+	opts.Resume = &Checkpoint{Listers: []ListerState{
+		{Bucket: "bucket", KeyMarker: "a/", EndKey: "c/", Done: true},
+		{Bucket: "bucket", KeyMarker: "c/", EndKey: "d/"},
+		{Bucket: "bucket", KeyMarker: "d/"},
+	}}
+
+	result, err := NewPurger(opts).Purge(context.Background(), []Target{{Bucket: "bucket"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Completed {
+		t.Fatal("purge did not complete")
+	}
+	for _, v := range srv.Versions("bucket") {
+		if v.Key > "c/" {
+			t.Errorf("%s was not deleted", v.Key)
+		}
+	}
+	if n := len(srv.Versions("bucket")); n == 0 {
+		t.Error("the range done before resuming was purged again")
+	}
+}
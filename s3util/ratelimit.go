@@ -0,0 +1,216 @@
+// Copyright 2018 Sergey Grankin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s3util
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+var (
+	statRateLimitWaits = metrics.NewRegisteredCounter("rate_limit_waits_total", nil)
+)
+
+// TokenBucket is a rate limiter that refills at Rate tokens per second up to
+// Burst tokens.  Taking more tokens than are available goes into debt, which
+// later takers wait out, so batches larger than the burst are still allowed.
+type TokenBucket struct {
+	Rate  float64
+	Burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func NewTokenBucket(rate float64) *TokenBucket {
+	burst := rate
+	if burst < 1 {
+		burst = 1
+	}
+	return &TokenBucket{Rate: rate, Burst: burst, tokens: burst, last: time.Now()}
+}
+
+// Wait takes n tokens, blocking until the bucket is out of debt or ctx is
+// done.
+func (b *TokenBucket) Wait(ctx context.Context, n int) error {
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.Rate
+	if b.tokens > b.Burst {
+		b.tokens = b.Burst
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	debt := -b.tokens
+	b.mu.Unlock()
+
+	if debt <= 0 {
+		return nil
+	}
+	statRateLimitWaits.Inc(1)
+	timer := time.NewTimer(time.Duration(debt / b.Rate * float64(time.Second)))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		b.mu.Lock()
+		b.tokens += float64(n) // never sent
+		b.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// full reports whether b has refilled to its burst by now, which makes it no
+// different from a new bucket.
+func (b *TokenBucket) full(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.tokens+now.Sub(b.last).Seconds()*b.Rate >= b.Burst
+}
+
+// RateLimits caps the rate of object deletions and list requests, either
+// overall, separately for each bucket, or separately for each key prefix of a
+// bucket.  A zero rate is unlimited.
+type RateLimits struct {
+	DeletesPerSec float64 // objects, since S3 counts each key in a batch
+	ListsPerSec   float64 // requests
+	PerBucket     bool
+
+	// PrefixDepth, if positive, applies the limits separately to each key
+	// prefix of up to that many /-separated directories in each bucket, as
+	// S3 limits partitioned prefixes rather than buckets.  Deleted keys
+	// count against their own prefix, and list requests against the listing
+	// prefix cut to that depth.
+	PrefixDepth int
+
+	mu      sync.Mutex
+	buckets map[string]*bucketLimits
+	swept   int // len(buckets) after the last sweep
+}
+
+type bucketLimits struct {
+	deletes *TokenBucket
+	lists   *TokenBucket
+}
+
+// idle reports whether l's buckets are full, so that l can be dropped and
+// created anew when next needed.
+func (l *bucketLimits) idle(now time.Time) bool {
+	return (l.deletes == nil || l.deletes.full(now)) && (l.lists == nil || l.lists.full(now))
+}
+
+// minSweep is the number of limits kept before idle ones are swept.
+const minSweep = 1024
+
+// limits returns the limits for key in bucket.
+func (r *RateLimits) limits(bucket, key string) *bucketLimits {
+	scope := ""
+	if r.PrefixDepth > 0 {
+		scope = bucket + "/" + keyPrefix(key, r.PrefixDepth)
+	} else if r.PerBucket {
+		scope = bucket
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.buckets == nil {
+		r.buckets = make(map[string]*bucketLimits)
+	}
+	l, ok := r.buckets[scope]
+	if !ok {
+		r.sweep()
+		l = &bucketLimits{}
+		if r.DeletesPerSec > 0 {
+			l.deletes = NewTokenBucket(r.DeletesPerSec)
+		}
+		if r.ListsPerSec > 0 {
+			l.lists = NewTokenBucket(r.ListsPerSec)
+		}
+		r.buckets[scope] = l
+	}
+	return l
+}
+
+// sweep drops idle limits once there are twice as many as after the last
+// sweep, so that limiting many prefixes takes bounded memory at an amortized
+// constant cost.  Limits in use are never idle, so none is dropped while it
+// is still limiting anything.
+func (r *RateLimits) sweep() {
+	if len(r.buckets) < minSweep || len(r.buckets) < 2*r.swept {
+		return
+	}
+	now := time.Now()
+	for scope, l := range r.buckets {
+		if l.idle(now) {
+			delete(r.buckets, scope)
+		}
+	}
+	r.swept = len(r.buckets)
+}
+
+// keyPrefix returns the first depth directories of key, e.g. "a/b/" for
+// "a/b/c/d" and depth 2.
+func keyPrefix(key string, depth int) string {
+	end := 0
+	for ; depth > 0; depth-- {
+		i := strings.IndexByte(key[end:], '/')
+		if i < 0 {
+			break
+		}
+		end += i + 1
+	}
+	return key[:end]
+}
+
+// waitDeletes waits until keys may be deleted from bucket.
+func (r *RateLimits) waitDeletes(ctx context.Context, bucket string, keys []string) error {
+	if r == nil {
+		return nil
+	}
+	counts := make(map[*TokenBucket]int)
+	var order []*TokenBucket
+	for _, key := range keys {
+		b := r.limits(bucket, key).deletes
+		if b == nil {
+			continue
+		}
+		if counts[b] == 0 {
+			order = append(order, b)
+		}
+		counts[b]++
+	}
+	for _, b := range order {
+		if err := b.Wait(ctx, counts[b]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// waitList waits until bucket may be listed under prefix.
+func (r *RateLimits) waitList(ctx context.Context, bucket, prefix string) error {
+	if r == nil {
+		return nil
+	}
+	if b := r.limits(bucket, prefix).lists; b != nil {
+		return b.Wait(ctx, 1)
+	}
+	return nil
+}
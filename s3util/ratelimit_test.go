@@ -0,0 +1,97 @@
+// Copyright 2018 Sergey Grankin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s3util
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestKeyPrefix(t *testing.T) {
+	for _, tc := range []struct {
+		key   string
+		depth int
+		want  string
+	}{
+		{"a/b/c/d", 2, "a/b/"},
+		{"a/b/c/d", 1, "a/"},
+		{"a/b", 2, "a/"},
+		{"a", 1, ""},
+		{"", 1, ""},
+	} {
+		if got := keyPrefix(tc.key, tc.depth); got != tc.want {
+			t.Errorf("keyPrefix(%q, %d) = %q, want %q", tc.key, tc.depth, got, tc.want)
+		}
+	}
+}
+
+func TestRateLimitsPerPrefix(t *testing.T) {
+	limits := &RateLimits{DeletesPerSec: 10, PrefixDepth: 1}
+	ctx := context.Background()
+
+	// Each prefix has its own burst of 10, so these don't wait.
+	start := time.Now()
+	if err := limits.waitDeletes(ctx, "b", []string{"x/1", "x/2", "x/3", "x/4", "x/5", "y/1", "y/2", "y/3", "y/4", "y/5"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := limits.waitDeletes(ctx, "b", []string{"x/6", "x/7", "x/8", "x/9", "x/10", "y/6", "y/7", "y/8", "y/9", "y/10"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := limits.waitDeletes(ctx, "other", []string{"x/1", "x/2", "x/3", "x/4", "x/5"}); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("separate prefixes waited %v", elapsed)
+	}
+
+	// The x/ prefix is out of tokens now.
+	start = time.Now()
+	if err := limits.waitDeletes(ctx, "b", []string{"x/11"}); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("exhausted prefix waited only %v", elapsed)
+	}
+}
+
+func TestRateLimitsSweep(t *testing.T) {
+	// Prefixes refill almost at once, unless deep in debt.
+	limits := &RateLimits{DeletesPerSec: 1e9, PrefixDepth: 1}
+	ctx := context.Background()
+	busy := limits.limits("b", "busy/")
+	busy.deletes.mu.Lock()
+	busy.deletes.tokens = -1e12
+	busy.deletes.mu.Unlock()
+
+	for i := 0; i < 10*minSweep; i++ {
+		key := fmt.Sprintf("%d/key", i)
+		if err := limits.waitDeletes(ctx, "b", []string{key}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	limits.mu.Lock()
+	n := len(limits.buckets)
+	_, kept := limits.buckets["b/busy/"]
+	limits.mu.Unlock()
+	if n > minSweep {
+		t.Errorf("%d limits kept, want at most %d", n, minSweep)
+	}
+	if !kept {
+		t.Error("limits of a prefix in debt were dropped")
+	}
+}
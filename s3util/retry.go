@@ -0,0 +1,118 @@
+// Copyright 2018 Sergey Grankin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s3util
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws/awserr"
+	"github.com/rcrowley/go-metrics"
+)
+
+const (
+	ErrCodeSlowDown           = "SlowDown"
+	ErrCodeServiceUnavailable = "ServiceUnavailable"
+	ErrCodeRequestTimeout     = "RequestTimeout"
+	ErrCodeRequestError       = "RequestError" // SDK code for transport failures, e.g. connection resets
+	ErrCodeResponseTimeout    = "ResponseTimeout"
+)
+
+var (
+	statRetries      = metrics.NewRegisteredCounter("retries_total", nil)
+	statRetryGiveups = metrics.NewRegisteredCounter("retry_giveups_total", nil)
+	statThrottles    = metrics.NewRegisteredCounter("throttles_total", nil)
+)
+
+// RetryPolicy is a bounded exponential backoff with full jitter: the delay
+// before retry n is uniformly distributed in [0, min(MaxDelay, BaseDelay*2^n)).
+type RetryPolicy struct {
+	MaxAttempts    int // total attempts, including the first
+	BaseDelay      time.Duration
+	MaxDelay       time.Duration
+	RetryableCodes map[string]bool
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 10,
+	BaseDelay:   100 * time.Millisecond,
+	MaxDelay:    20 * time.Second,
+	RetryableCodes: map[string]bool{
+		ErrCodeInternalError:      true,
+		ErrCodeSlowDown:           true,
+		ErrCodeServiceUnavailable: true,
+		ErrCodeRequestTimeout:     true,
+		ErrCodeRequestError:       true,
+		ErrCodeResponseTimeout:    true,
+	},
+}
+
+func (p *RetryPolicy) retryable(err error) bool {
+	return p.RetryableCodes[errorCode(err)]
+}
+
+// backoff returns the delay before the given retry (starting at 1).
+func (p *RetryPolicy) backoff(retry int) time.Duration {
+	ceil := p.MaxDelay
+	if retry < 32 {
+		if d := p.BaseDelay << uint(retry-1); d > 0 && d < ceil {
+			ceil = d
+		}
+	}
+	if ceil <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(ceil)))
+}
+
+// wait sleeps before the next attempt, or returns false if attempt was the
+// last one allowed or ctx is done.
+func (p *RetryPolicy) wait(ctx context.Context, attempt int) bool {
+	if attempt >= p.MaxAttempts {
+		statRetryGiveups.Inc(1)
+		return false
+	}
+	statRetries.Inc(1)
+
+	timer := time.NewTimer(p.backoff(attempt))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// noteThrottle counts responses asking the client to slow down, and passes
+// them on to the client's OnThrottle hook.
+func (client *S3) noteThrottle(code string) {
+	if code != ErrCodeSlowDown && code != ErrCodeServiceUnavailable {
+		return
+	}
+	statThrottles.Inc(1)
+	if client.OnThrottle != nil {
+		client.OnThrottle()
+	}
+}
+
+// errorCode returns the AWS error code of err, or "" if it has none.
+func errorCode(err error) string {
+	if err, ok := err.(awserr.Error); ok {
+		return err.Code()
+	}
+	return ""
+}
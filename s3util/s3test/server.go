@@ -0,0 +1,564 @@
+// Copyright 2018 Sergey Grankin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package s3test provides an in-memory fake of the parts of the S3 API used
+// by s3util, served over HTTP for tests.  Buckets are always versioned and
+// must be addressed path-style.  Requests are not authenticated.
+package s3test
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Operations served, as named in the S3 API.
+const (
+	OpListObjectVersions   = "ListObjectVersions"
+	OpDeleteObjects        = "DeleteObjects"
+	OpListMultipartUploads = "ListMultipartUploads"
+	OpAbortMultipartUpload = "AbortMultipartUpload"
+	OpDeleteBucket         = "DeleteBucket"
+	OpGetBucketLocation    = "GetBucketLocation"
+)
+
+const timeFormat = "2006-01-02T15:04:05.000Z"
+
+// Object is an object version or delete marker stored in a bucket.
+type Object struct {
+	Key          string
+	VersionId    string // set by Put; increases with each Put
+	IsLatest     bool   // set when listed
+	DeleteMarker bool
+	LastModified time.Time // defaults to the time of Put
+	Size         int64
+	StorageClass string // defaults to STANDARD
+}
+
+// Upload is an in-progress multipart upload.
+type Upload struct {
+	Key       string
+	UploadId  string
+	Initiated time.Time
+}
+
+type bucket struct {
+	region  string
+	objects []*Object // by key, then newest first
+	uploads []*Upload // by key, then upload ID
+}
+
+type fault struct {
+	op    string // empty for per-key DeleteObjects failures
+	code  string
+	count int
+}
+
+// Server is a fake S3 endpoint.
+type Server struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	pageSize int
+	buckets  map[string]*bucket
+	faults   []*fault
+	requests map[string]int
+	seq      int
+}
+
+// NewServer starts a fake with no buckets.  Close it when done.
+func NewServer() *Server {
+	s := &Server{
+		buckets:  make(map[string]*bucket),
+		requests: make(map[string]int),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// SetPageSize limits listings to n entries per page, below any limit
+// requested by the client.  Zero restores the S3 default of 1000.
+func (s *Server) SetPageSize(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pageSize = n
+}
+
+// CreateBucket creates an empty bucket located in region.
+func (s *Server) CreateBucket(name, region string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.buckets[name] = &bucket{region: region}
+}
+
+// HasBucket reports whether the bucket exists.
+func (s *Server) HasBucket(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.buckets[name] != nil
+}
+
+// Put stores a new version of obj.Key, or a delete marker for it, as the
+// latest version, and returns its version ID.
+func (s *Server) Put(bucketName string, obj Object) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b := s.mustBucket(bucketName)
+
+	s.seq++
+	obj.VersionId = fmt.Sprintf("v%08d", s.seq)
+	if obj.LastModified.IsZero() {
+		obj.LastModified = time.Now().UTC()
+	}
+	if obj.StorageClass == "" && !obj.DeleteMarker {
+		obj.StorageClass = "STANDARD"
+	}
+	// Newer versions sort first within a key, so insert ahead of the others.
+	i := sort.Search(len(b.objects), func(i int) bool { return b.objects[i].Key >= obj.Key })
+	b.objects = append(b.objects, nil)
+	copy(b.objects[i+1:], b.objects[i:])
+	b.objects[i] = &obj
+	return obj.VersionId
+}
+
+// Versions returns every version and delete marker in the bucket, in listing
+// order.
+func (s *Server) Versions(bucketName string) []Object {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b := s.mustBucket(bucketName)
+	objs := make([]Object, len(b.objects))
+	for i, obj := range b.objects {
+		objs[i] = *obj
+		objs[i].IsLatest = i == 0 || b.objects[i-1].Key != obj.Key
+	}
+	return objs
+}
+
+// CreateUpload starts a multipart upload and returns its ID.
+func (s *Server) CreateUpload(bucketName, key string, initiated time.Time) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b := s.mustBucket(bucketName)
+
+	s.seq++
+	up := &Upload{Key: key, UploadId: fmt.Sprintf("u%08d", s.seq), Initiated: initiated.UTC()}
+	b.uploads = append(b.uploads, up)
+	sort.Slice(b.uploads, func(i, j int) bool {
+		if b.uploads[i].Key != b.uploads[j].Key {
+			return b.uploads[i].Key < b.uploads[j].Key
+		}
+		return b.uploads[i].UploadId < b.uploads[j].UploadId
+	})
+	return up.UploadId
+}
+
+// Uploads returns the in-progress uploads in the bucket.
+func (s *Server) Uploads(bucketName string) []Upload {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b := s.mustBucket(bucketName)
+	ups := make([]Upload, len(b.uploads))
+	for i, up := range b.uploads {
+		ups[i] = *up
+	}
+	return ups
+}
+
+// Fail makes the next n requests for op fail with the error code, e.g.
+// InternalError or SlowDown.
+func (s *Server) Fail(op, code string, n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = append(s.faults, &fault{op: op, code: code, count: n})
+}
+
+// FailKeys makes the next n keys sent to DeleteObjects fail with the error
+// code, leaving them in place, while the rest of each batch succeeds.
+func (s *Server) FailKeys(code string, n int) {
+	s.Fail("", code, n)
+}
+
+// Requests returns the number of requests received for op, including failed
+// ones.
+func (s *Server) Requests(op string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[op]
+}
+
+func (s *Server) mustBucket(name string) *bucket {
+	b := s.buckets[name]
+	if b == nil {
+		panic("s3test: no such bucket " + name)
+	}
+	return b
+}
+
+// takeFault consumes and returns the code of a pending fault for op, if any.
+func (s *Server) takeFault(op string) string {
+	for i, f := range s.faults {
+		if f.op != op {
+			continue
+		}
+		f.count--
+		if f.count <= 0 {
+			s.faults = append(s.faults[:i], s.faults[i+1:]...)
+		}
+		return f.code
+	}
+	return ""
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.seq++
+	w.Header().Set("X-Amz-Request-Id", fmt.Sprintf("req%08d", s.seq))
+
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	bucketName, key := path, ""
+	if i := strings.IndexByte(path, '/'); i >= 0 {
+		bucketName, key = path[:i], path[i+1:]
+	}
+	query := r.URL.Query()
+	has := func(param string) bool { _, ok := query[param]; return ok }
+
+	var op string
+	switch {
+	case r.Method == "GET" && key == "" && has("versions"):
+		op = OpListObjectVersions
+	case r.Method == "GET" && key == "" && has("uploads"):
+		op = OpListMultipartUploads
+	case r.Method == "GET" && key == "" && has("location"):
+		op = OpGetBucketLocation
+	case r.Method == "POST" && key == "" && has("delete"):
+		op = OpDeleteObjects
+	case r.Method == "DELETE" && key != "" && has("uploadId"):
+		op = OpAbortMultipartUpload
+	case r.Method == "DELETE" && key == "":
+		op = OpDeleteBucket
+	default:
+		writeError(w, "NotImplemented", r.Method+" "+r.URL.String())
+		return
+	}
+	s.requests[op]++
+
+	if code := s.takeFault(op); code != "" {
+		writeError(w, code, "injected failure")
+		return
+	}
+	b := s.buckets[bucketName]
+	if b == nil {
+		writeError(w, "NoSuchBucket", bucketName)
+		return
+	}
+
+	switch op {
+	case OpListObjectVersions:
+		s.listObjectVersions(w, b, bucketName, query)
+	case OpListMultipartUploads:
+		s.listMultipartUploads(w, b, bucketName, query)
+	case OpGetBucketLocation:
+		writeXML(w, struct {
+			XMLName xml.Name `xml:"LocationConstraint"`
+			Region  string   `xml:",chardata"`
+		}{Region: b.region})
+	case OpDeleteObjects:
+		s.deleteObjects(w, r, b)
+	case OpAbortMultipartUpload:
+		for i, up := range b.uploads {
+			if up.Key == key && up.UploadId == query.Get("uploadId") {
+				b.uploads = append(b.uploads[:i], b.uploads[i+1:]...)
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+		writeError(w, "NoSuchUpload", key)
+	case OpDeleteBucket:
+		if len(b.objects) > 0 || len(b.uploads) > 0 {
+			writeError(w, "BucketNotEmpty", bucketName)
+			return
+		}
+		delete(s.buckets, bucketName)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (s *Server) maxKeys(query map[string][]string) int {
+	n := 1000
+	if v, err := strconv.Atoi(first(query["max-keys"])); err == nil && v > 0 && v < n {
+		n = v
+	}
+	if s.pageSize > 0 && s.pageSize < n {
+		n = s.pageSize
+	}
+	return n
+}
+
+type listVersionsResult struct {
+	XMLName             xml.Name          `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListVersionsResult"`
+	Name                string            `xml:"Name"`
+	Prefix              string            `xml:"Prefix"`
+	IsTruncated         bool              `xml:"IsTruncated"`
+	NextKeyMarker       string            `xml:"NextKeyMarker,omitempty"`
+	NextVersionIdMarker string            `xml:"NextVersionIdMarker,omitempty"`
+	Versions            []xmlVersion      `xml:"Version"`
+	DeleteMarkers       []xmlVersion      `xml:"DeleteMarker"`
+	CommonPrefixes      []xmlCommonPrefix `xml:"CommonPrefixes"`
+}
+
+type xmlVersion struct {
+	Key          string `xml:"Key"`
+	VersionId    string `xml:"VersionId"`
+	IsLatest     bool   `xml:"IsLatest"`
+	LastModified string `xml:"LastModified"`
+	Size         *int64 `xml:"Size,omitempty"`
+	StorageClass string `xml:"StorageClass,omitempty"`
+}
+
+type xmlCommonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+// listObjectVersions lists from the markers as S3 does: after the given
+// version of the key marker, or after every version of it if no version ID
+// marker is given.  With a delimiter, keys are rolled up into common
+// prefixes, each counting as one entry.  Like S3, it rejects a version ID
+// marker that is present but empty.
+func (s *Server) listObjectVersions(w http.ResponseWriter, b *bucket, name string, query map[string][]string) {
+	if markers, ok := query["version-id-marker"]; ok && first(markers) == "" {
+		writeError(w, "InvalidArgument", "A version-id marker cannot be empty.")
+		return
+	}
+	prefix := first(query["prefix"])
+	delimiter := first(query["delimiter"])
+	keyMarker := first(query["key-marker"])
+	versionIdMarker := first(query["version-id-marker"])
+	limit := s.maxKeys(query)
+
+	// Versions of a key are listed newest first, i.e. by descending version
+	// ID.  The marker need not exist any more: it may have been deleted since.
+	start := 0
+	if keyMarker != "" {
+		start = sort.Search(len(b.objects), func(i int) bool {
+			obj := b.objects[i]
+			return obj.Key > keyMarker ||
+				obj.Key == keyMarker && versionIdMarker != "" && obj.VersionId < versionIdMarker
+		})
+	}
+
+	result := listVersionsResult{Name: name, Prefix: prefix}
+	count := 0
+	lastPrefix := ""
+	for i := start; i < len(b.objects); i++ {
+		obj := b.objects[i]
+		if !strings.HasPrefix(obj.Key, prefix) {
+			continue
+		}
+		if delimiter != "" {
+			if j := strings.Index(obj.Key[len(prefix):], delimiter); j >= 0 {
+				cp := obj.Key[:len(prefix)+j+len(delimiter)]
+				if cp == lastPrefix || cp == keyMarker {
+					continue
+				}
+				if count == limit {
+					result.IsTruncated = true
+					break
+				}
+				result.CommonPrefixes = append(result.CommonPrefixes, xmlCommonPrefix{cp})
+				result.NextKeyMarker, result.NextVersionIdMarker = cp, ""
+				lastPrefix = cp
+				count++
+				continue
+			}
+		}
+		if count == limit {
+			result.IsTruncated = true
+			break
+		}
+		v := xmlVersion{
+			Key:          obj.Key,
+			VersionId:    obj.VersionId,
+			IsLatest:     i == 0 || b.objects[i-1].Key != obj.Key,
+			LastModified: obj.LastModified.UTC().Format(timeFormat),
+		}
+		if obj.DeleteMarker {
+			result.DeleteMarkers = append(result.DeleteMarkers, v)
+		} else {
+			size := obj.Size
+			v.Size, v.StorageClass = &size, obj.StorageClass
+			result.Versions = append(result.Versions, v)
+		}
+		result.NextKeyMarker, result.NextVersionIdMarker = obj.Key, obj.VersionId
+		count++
+	}
+	if !result.IsTruncated {
+		result.NextKeyMarker, result.NextVersionIdMarker = "", ""
+	}
+	writeXML(w, result)
+}
+
+type listUploadsResult struct {
+	XMLName            xml.Name    `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListMultipartUploadsResult"`
+	Bucket             string      `xml:"Bucket"`
+	Prefix             string      `xml:"Prefix"`
+	IsTruncated        bool        `xml:"IsTruncated"`
+	NextKeyMarker      string      `xml:"NextKeyMarker,omitempty"`
+	NextUploadIdMarker string      `xml:"NextUploadIdMarker,omitempty"`
+	Uploads            []xmlUpload `xml:"Upload"`
+}
+
+type xmlUpload struct {
+	Key       string `xml:"Key"`
+	UploadId  string `xml:"UploadId"`
+	Initiated string `xml:"Initiated"`
+}
+
+func (s *Server) listMultipartUploads(w http.ResponseWriter, b *bucket, name string, query map[string][]string) {
+	prefix := first(query["prefix"])
+	keyMarker := first(query["key-marker"])
+	uploadIdMarker := first(query["upload-id-marker"])
+	limit := s.maxKeys(query)
+
+	result := listUploadsResult{Bucket: name, Prefix: prefix}
+	for _, up := range b.uploads {
+		if !strings.HasPrefix(up.Key, prefix) {
+			continue
+		}
+		if keyMarker != "" && (up.Key < keyMarker ||
+			up.Key == keyMarker && (uploadIdMarker == "" || up.UploadId <= uploadIdMarker)) {
+			continue
+		}
+		if len(result.Uploads) == limit {
+			result.IsTruncated = true
+			break
+		}
+		result.Uploads = append(result.Uploads, xmlUpload{
+			Key:       up.Key,
+			UploadId:  up.UploadId,
+			Initiated: up.Initiated.Format(timeFormat),
+		})
+		result.NextKeyMarker, result.NextUploadIdMarker = up.Key, up.UploadId
+	}
+	if !result.IsTruncated {
+		result.NextKeyMarker, result.NextUploadIdMarker = "", ""
+	}
+	writeXML(w, result)
+}
+
+type deleteRequest struct {
+	Objects []struct {
+		Key       string `xml:"Key"`
+		VersionId string `xml:"VersionId"`
+	} `xml:"Object"`
+	Quiet bool `xml:"Quiet"`
+}
+
+type deleteResult struct {
+	XMLName xml.Name         `xml:"http://s3.amazonaws.com/doc/2006-03-01/ DeleteResult"`
+	Deleted []xmlDeleted     `xml:"Deleted"`
+	Errors  []xmlDeleteError `xml:"Error"`
+}
+
+type xmlDeleted struct {
+	Key       string `xml:"Key"`
+	VersionId string `xml:"VersionId"`
+}
+
+type xmlDeleteError struct {
+	Key       string `xml:"Key"`
+	VersionId string `xml:"VersionId"`
+	Code      string `xml:"Code"`
+	Message   string `xml:"Message"`
+}
+
+// deleteObjects deletes the requested versions.  As in S3, deleting a
+// version that does not exist succeeds.
+func (s *Server) deleteObjects(w http.ResponseWriter, r *http.Request, b *bucket) {
+	var req deleteRequest
+	if err := xml.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, "MalformedXML", err.Error())
+		return
+	}
+	if len(req.Objects) > 1000 {
+		writeError(w, "MalformedXML", "more than 1000 objects")
+		return
+	}
+
+	var result deleteResult
+	for _, o := range req.Objects {
+		if code := s.takeFault(""); code != "" {
+			result.Errors = append(result.Errors, xmlDeleteError{
+				Key: o.Key, VersionId: o.VersionId, Code: code, Message: "injected failure",
+			})
+			continue
+		}
+		for i, obj := range b.objects {
+			if obj.Key == o.Key && obj.VersionId == o.VersionId {
+				b.objects = append(b.objects[:i], b.objects[i+1:]...)
+				break
+			}
+		}
+		if !req.Quiet {
+			result.Deleted = append(result.Deleted, xmlDeleted{Key: o.Key, VersionId: o.VersionId})
+		}
+	}
+	writeXML(w, result)
+}
+
+var errorStatus = map[string]int{
+	"AccessDenied":       http.StatusForbidden,
+	"BucketNotEmpty":     http.StatusConflict,
+	"InternalError":      http.StatusInternalServerError,
+	"NoSuchBucket":       http.StatusNotFound,
+	"NoSuchUpload":       http.StatusNotFound,
+	"NotImplemented":     http.StatusNotImplemented,
+	"ServiceUnavailable": http.StatusServiceUnavailable,
+	"SlowDown":           http.StatusServiceUnavailable,
+}
+
+func writeError(w http.ResponseWriter, code, message string) {
+	status, ok := errorStatus[code]
+	if !ok {
+		status = http.StatusBadRequest
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string   `xml:"Code"`
+		Message string   `xml:"Message"`
+	}{Code: code, Message: message})
+}
+
+func writeXML(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(v)
+}
+
+func first(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
@@ -0,0 +1,163 @@
+// Copyright 2018 Sergey Grankin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s3util
+
+import (
+	"context"
+	"sync"
+
+	"github.com/rcrowley/go-metrics"
+)
+
+var (
+	statRangesSplit = metrics.NewRegisteredCounter("ranges_split_total", nil)
+)
+
+// shardPool hands out key ranges to listers.  When none are queued, an idle
+// lister splits the widest range still being listed and takes its upper half,
+// so that even a single prefix is listed in parallel whatever its key
+// structure.
+type shardPool struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	progress *tracker
+	queued   []*listerProgress
+	active   []*listerProgress
+	stopped  bool
+}
+
+func newShardPool(ctx context.Context, progress *tracker) *shardPool {
+	p := &shardPool{progress: progress}
+	p.cond = sync.NewCond(&p.mu)
+	progress.onSplittable = p.wake
+	go func() {
+		<-ctx.Done()
+		p.mu.Lock()
+		p.stopped = true
+		p.cond.Broadcast()
+		p.mu.Unlock()
+	}()
+	return p
+}
+
+func (p *shardPool) add(lp *listerProgress) {
+	p.mu.Lock()
+	p.queued = append(p.queued, lp)
+	p.cond.Signal()
+	p.mu.Unlock()
+}
+
+// wake lets listers waiting in take look for a range to split again.
+func (p *shardPool) wake() {
+	p.mu.Lock()
+	p.cond.Broadcast()
+	p.mu.Unlock()
+}
+
+// take returns the next range to list, blocking while every range is being
+// listed and none can be split.  It returns nil once all ranges are done or
+// the pool is stopped.
+func (p *shardPool) take() *listerProgress {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for !p.stopped {
+		if len(p.queued) > 0 {
+			lp := p.queued[0]
+			p.queued = p.queued[1:]
+			p.active = append(p.active, lp)
+			return lp
+		}
+		if len(p.active) == 0 {
+			return nil
+		}
+		if lp := p.steal(); lp != nil {
+			p.active = append(p.active, lp)
+			return lp
+		}
+		p.cond.Wait()
+	}
+	return nil
+}
+
+// done marks a range taken from the pool as finished.
+func (p *shardPool) done(lp *listerProgress) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, a := range p.active {
+		if a == lp {
+			p.active = append(p.active[:i], p.active[i+1:]...)
+			break
+		}
+	}
+	p.cond.Broadcast()
+}
+
+// steal splits the active range with the most key space left to list.
+func (p *shardPool) steal() *listerProgress {
+	candidates := append([]*listerProgress(nil), p.active...)
+	for len(candidates) > 0 {
+		widest, span := 0, -1.0
+		for i, lp := range candidates {
+			if s := lp.span(); s > span {
+				widest, span = i, s
+			}
+		}
+		if upper := p.progress.split(candidates[widest]); upper != nil {
+			statRangesSplit.Inc(1)
+			return upper
+		}
+		candidates = append(candidates[:widest], candidates[widest+1:]...)
+	}
+	return nil
+}
+
+// seed queues the key ranges for a target.  Unless they are resumed from a
+// checkpoint, the prefix is split at the first level of common prefixes under
+// it, which gives the listers a head start over splitting blindly.  Stores
+// that can't list common prefixes start with a single range.
+func (p *shardPool) seed(ctx context.Context, store ObjectStore, t Target, resumed *Checkpoint) {
+	if todo, ok := p.progress.resume(t.Bucket, t.Prefix, resumed); ok {
+		for _, lp := range todo {
+			p.add(lp)
+		}
+		return
+	}
+
+	var bounds []string
+	if pl, ok := store.(PrefixLister); ok {
+		var err error
+		if bounds, err = pl.CommonPrefixes(ctx, t.Bucket, t.Prefix, "/"); err != nil {
+			LogError("probe_failed", Fields{"bucket": t.Bucket, "prefix": t.Prefix, "error": err},
+				"probing %s/%s: %v", t.Bucket, t.Prefix, err)
+			bounds = nil
+		}
+	}
+
+	start := ""
+	for _, end := range bounds {
+		p.add(p.progress.add(ListerState{
+			Bucket:    t.Bucket,
+			Prefix:    t.Prefix,
+			KeyMarker: start,
+			EndKey:    end,
+		}))
+		start = end
+	}
+	p.add(p.progress.add(ListerState{
+		Bucket:    t.Bucket,
+		Prefix:    t.Prefix,
+		KeyMarker: start,
+	}))
+}
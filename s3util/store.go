@@ -0,0 +1,51 @@
+// Copyright 2018 Sergey Grankin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s3util
+
+import (
+	"context"
+)
+
+// ObjectStore is the storage that the purge pipeline lists and deletes from.
+// *S3 is the AWS implementation.
+type ObjectStore interface {
+	// ListObjectVersions pages through the versions and delete markers under
+	// prefix, starting after start, as described on S3.ListObjectVersions.
+	ListObjectVersions(ctx context.Context, bucket, prefix string, start Marker, out func(page *Page) error) error
+
+	// DeleteObjectVersions deletes a batch of versions, failing with a
+	// *DeleteError.
+	DeleteObjectVersions(ctx context.Context, bucket string, versions []Version) error
+
+	DeleteBucket(ctx context.Context, bucket string) error
+
+	// ListMultipartUploads pages through the in-progress uploads under prefix.
+	ListMultipartUploads(ctx context.Context, bucket, prefix string, out func(uploads []Upload) error) error
+
+	// AbortMultipartUpload aborts an upload.  An upload that no longer exists
+	// counts as aborted.
+	AbortMultipartUpload(ctx context.Context, bucket string, upload Upload) error
+}
+
+// PrefixLister is implemented by stores that can list the common prefixes of
+// keys, which are used to split listings into key ranges up front.
+type PrefixLister interface {
+	CommonPrefixes(ctx context.Context, bucket, prefix, delimiter string) ([]string, error)
+}
+
+var (
+	_ ObjectStore  = (*S3)(nil)
+	_ PrefixLister = (*S3)(nil)
+)
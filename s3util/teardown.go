@@ -0,0 +1,353 @@
+// Copyright 2018 Sergey Grankin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package s3util
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// BucketConfig is a snapshot of a bucket's configuration sub-resources.
+// Sub-resources that are not configured are left empty.
+type BucketConfig struct {
+	Bucket  string    `json:"bucket"`
+	TakenAt time.Time `json:"taken_at"`
+
+	Versioning   *s3.GetBucketVersioningOutput                `json:"versioning,omitempty"`
+	Policy       *string                                      `json:"policy,omitempty"`
+	Replication  *s3.ReplicationConfiguration                 `json:"replication,omitempty"`
+	Lifecycle    []s3.LifecycleRule                           `json:"lifecycle,omitempty"`
+	Notification *s3.GetBucketNotificationConfigurationOutput `json:"notification,omitempty"`
+	CORS         []s3.CORSRule                                `json:"cors,omitempty"`
+	Website      *s3.GetBucketWebsiteOutput                   `json:"website,omitempty"`
+	Inventory    []s3.InventoryConfiguration                  `json:"inventory,omitempty"`
+	Analytics    []s3.AnalyticsConfiguration                  `json:"analytics,omitempty"`
+	Metrics      []s3.MetricsConfiguration                    `json:"metrics,omitempty"`
+	Tagging      []s3.Tag                                     `json:"tagging,omitempty"`
+	Encryption   *s3.ServerSideEncryptionConfiguration        `json:"encryption,omitempty"`
+}
+
+// call sends the request for the operation op made by send, retrying
+// according to the client's retry policy.
+func (client *S3) call(ctx context.Context, op string, send func() error) error {
+	for attempt := 1; ; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		start := time.Now()
+		err := send()
+		observeRequest(op, start, err)
+		if err != nil {
+			client.noteThrottle(errorCode(err))
+		}
+		if err == nil || !client.Retry.retryable(err) || !client.Retry.wait(ctx, attempt) {
+			return err
+		}
+	}
+}
+
+// notConfigured reports whether err means the sub-resource being fetched is
+// not set, e.g. NoSuchBucketPolicy or ReplicationConfigurationNotFoundError.
+func notConfigured(err error) bool {
+	code := errorCode(err)
+	return code != s3.ErrCodeNoSuchBucket &&
+		(strings.HasPrefix(code, "NoSuch") || strings.HasSuffix(code, "NotFoundError"))
+}
+
+// SnapshotBucketConfig fetches every configuration sub-resource of bucket
+// that teardown removes.
+func (client *S3) SnapshotBucketConfig(ctx context.Context, bucket string) (*BucketConfig, error) {
+	cfg := &BucketConfig{Bucket: bucket, TakenAt: time.Now().UTC()}
+	in := func(op string, err error) error {
+		if err == nil || notConfigured(err) {
+			return nil
+		}
+		return &BucketError{Bucket: bucket, Op: op, Err: err}
+	}
+
+	steps := []struct {
+		op   string
+		send func() error
+	}{
+		{"GetBucketVersioning", func() error {
+			req := client.forBucket(bucket).GetBucketVersioningRequest(&s3.GetBucketVersioningInput{Bucket: &bucket})
+			req.SetContext(ctx)
+			out, err := req.Send()
+			cfg.Versioning = out
+			return err
+		}},
+		{"GetBucketPolicy", func() error {
+			req := client.forBucket(bucket).GetBucketPolicyRequest(&s3.GetBucketPolicyInput{Bucket: &bucket})
+			req.SetContext(ctx)
+			out, err := req.Send()
+			if err == nil {
+				cfg.Policy = out.Policy
+			}
+			return err
+		}},
+		{"GetBucketReplication", func() error {
+			req := client.forBucket(bucket).GetBucketReplicationRequest(&s3.GetBucketReplicationInput{Bucket: &bucket})
+			req.SetContext(ctx)
+			out, err := req.Send()
+			if err == nil {
+				cfg.Replication = out.ReplicationConfiguration
+			}
+			return err
+		}},
+		{"GetBucketLifecycleConfiguration", func() error {
+			req := client.forBucket(bucket).GetBucketLifecycleConfigurationRequest(&s3.GetBucketLifecycleConfigurationInput{Bucket: &bucket})
+			req.SetContext(ctx)
+			out, err := req.Send()
+			if err == nil {
+				cfg.Lifecycle = out.Rules
+			}
+			return err
+		}},
+		{"GetBucketNotificationConfiguration", func() error {
+			req := client.forBucket(bucket).GetBucketNotificationConfigurationRequest(&s3.GetBucketNotificationConfigurationInput{Bucket: &bucket})
+			req.SetContext(ctx)
+			out, err := req.Send()
+			cfg.Notification = out
+			return err
+		}},
+		{"GetBucketCors", func() error {
+			req := client.forBucket(bucket).GetBucketCorsRequest(&s3.GetBucketCorsInput{Bucket: &bucket})
+			req.SetContext(ctx)
+			out, err := req.Send()
+			if err == nil {
+				cfg.CORS = out.CORSRules
+			}
+			return err
+		}},
+		{"GetBucketWebsite", func() error {
+			req := client.forBucket(bucket).GetBucketWebsiteRequest(&s3.GetBucketWebsiteInput{Bucket: &bucket})
+			req.SetContext(ctx)
+			out, err := req.Send()
+			cfg.Website = out
+			return err
+		}},
+		{"ListBucketInventoryConfigurations", func() error {
+			cfg.Inventory = nil
+			var token *string
+			for {
+				req := client.forBucket(bucket).ListBucketInventoryConfigurationsRequest(&s3.ListBucketInventoryConfigurationsInput{
+					Bucket:            &bucket,
+					ContinuationToken: token,
+				})
+				req.SetContext(ctx)
+				out, err := req.Send()
+				if err != nil {
+					return err
+				}
+				cfg.Inventory = append(cfg.Inventory, out.InventoryConfigurationList...)
+				if !aws.BoolValue(out.IsTruncated) {
+					return nil
+				}
+				token = out.NextContinuationToken
+			}
+		}},
+		{"ListBucketAnalyticsConfigurations", func() error {
+			cfg.Analytics = nil
+			var token *string
+			for {
+				req := client.forBucket(bucket).ListBucketAnalyticsConfigurationsRequest(&s3.ListBucketAnalyticsConfigurationsInput{
+					Bucket:            &bucket,
+					ContinuationToken: token,
+				})
+				req.SetContext(ctx)
+				out, err := req.Send()
+				if err != nil {
+					return err
+				}
+				cfg.Analytics = append(cfg.Analytics, out.AnalyticsConfigurationList...)
+				if !aws.BoolValue(out.IsTruncated) {
+					return nil
+				}
+				token = out.NextContinuationToken
+			}
+		}},
+		{"ListBucketMetricsConfigurations", func() error {
+			cfg.Metrics = nil
+			var token *string
+			for {
+				req := client.forBucket(bucket).ListBucketMetricsConfigurationsRequest(&s3.ListBucketMetricsConfigurationsInput{
+					Bucket:            &bucket,
+					ContinuationToken: token,
+				})
+				req.SetContext(ctx)
+				out, err := req.Send()
+				if err != nil {
+					return err
+				}
+				cfg.Metrics = append(cfg.Metrics, out.MetricsConfigurationList...)
+				if !aws.BoolValue(out.IsTruncated) {
+					return nil
+				}
+				token = out.NextContinuationToken
+			}
+		}},
+		{"GetBucketTagging", func() error {
+			req := client.forBucket(bucket).GetBucketTaggingRequest(&s3.GetBucketTaggingInput{Bucket: &bucket})
+			req.SetContext(ctx)
+			out, err := req.Send()
+			if err == nil {
+				cfg.Tagging = out.TagSet
+			}
+			return err
+		}},
+		{"GetBucketEncryption", func() error {
+			req := client.forBucket(bucket).GetBucketEncryptionRequest(&s3.GetBucketEncryptionInput{Bucket: &bucket})
+			req.SetContext(ctx)
+			out, err := req.Send()
+			if err == nil {
+				cfg.Encryption = out.ServerSideEncryptionConfiguration
+			}
+			return err
+		}},
+	}
+	for _, step := range steps {
+		if err := in(step.op, client.call(ctx, step.op, step.send)); err != nil {
+			return nil, err
+		}
+	}
+	return cfg, nil
+}
+
+// StopBucketActivity removes the replication and lifecycle configurations of
+// bucket, so that neither writes nor expires objects while it is purged.
+func (client *S3) StopBucketActivity(ctx context.Context, bucket string) error {
+	LogInfo("bucket_activity_stopping", Fields{"bucket": bucket}, "disabling replication and lifecycle on %s", bucket)
+	if err := client.call(ctx, "DeleteBucketReplication", func() error {
+		req := client.forBucket(bucket).DeleteBucketReplicationRequest(&s3.DeleteBucketReplicationInput{Bucket: &bucket})
+		req.SetContext(ctx)
+		_, err := req.Send()
+		return err
+	}); err != nil && !notConfigured(err) {
+		return &BucketError{Bucket: bucket, Op: "DeleteBucketReplication", Err: err}
+	}
+	if err := client.call(ctx, "DeleteBucketLifecycle", func() error {
+		req := client.forBucket(bucket).DeleteBucketLifecycleRequest(&s3.DeleteBucketLifecycleInput{Bucket: &bucket})
+		req.SetContext(ctx)
+		_, err := req.Send()
+		return err
+	}); err != nil && !notConfigured(err) {
+		return &BucketError{Bucket: bucket, Op: "DeleteBucketLifecycle", Err: err}
+	}
+	return nil
+}
+
+// DeleteBucketConfig removes the remaining sub-resources recorded in cfg:
+// the policy, notifications, CORS, website, inventory, analytics and metrics
+// configurations, tags and default encryption.
+func (client *S3) DeleteBucketConfig(ctx context.Context, cfg *BucketConfig) error {
+	bucket := cfg.Bucket
+	LogInfo("bucket_config_removing", Fields{"bucket": bucket}, "removing configuration of %s", bucket)
+
+	type step struct {
+		op   string
+		send func() error
+	}
+	var steps []step
+	if cfg.Policy != nil {
+		steps = append(steps, step{"DeleteBucketPolicy", func() error {
+			req := client.forBucket(bucket).DeleteBucketPolicyRequest(&s3.DeleteBucketPolicyInput{Bucket: &bucket})
+			req.SetContext(ctx)
+			_, err := req.Send()
+			return err
+		}})
+	}
+	if n := cfg.Notification; n != nil &&
+		len(n.LambdaFunctionConfigurations)+len(n.QueueConfigurations)+len(n.TopicConfigurations) > 0 {
+		steps = append(steps, step{"PutBucketNotificationConfiguration", func() error {
+			req := client.forBucket(bucket).PutBucketNotificationConfigurationRequest(&s3.PutBucketNotificationConfigurationInput{
+				Bucket:                    &bucket,
+				NotificationConfiguration: &s3.GetBucketNotificationConfigurationOutput{},
+			})
+			req.SetContext(ctx)
+			_, err := req.Send()
+			return err
+		}})
+	}
+	if len(cfg.CORS) > 0 {
+		steps = append(steps, step{"DeleteBucketCors", func() error {
+			req := client.forBucket(bucket).DeleteBucketCorsRequest(&s3.DeleteBucketCorsInput{Bucket: &bucket})
+			req.SetContext(ctx)
+			_, err := req.Send()
+			return err
+		}})
+	}
+	if w := cfg.Website; w != nil && (w.IndexDocument != nil || w.RedirectAllRequestsTo != nil) {
+		steps = append(steps, step{"DeleteBucketWebsite", func() error {
+			req := client.forBucket(bucket).DeleteBucketWebsiteRequest(&s3.DeleteBucketWebsiteInput{Bucket: &bucket})
+			req.SetContext(ctx)
+			_, err := req.Send()
+			return err
+		}})
+	}
+	for _, inv := range cfg.Inventory {
+		id := inv.Id
+		steps = append(steps, step{"DeleteBucketInventoryConfiguration", func() error {
+			req := client.forBucket(bucket).DeleteBucketInventoryConfigurationRequest(&s3.DeleteBucketInventoryConfigurationInput{Bucket: &bucket, Id: id})
+			req.SetContext(ctx)
+			_, err := req.Send()
+			return err
+		}})
+	}
+	for _, an := range cfg.Analytics {
+		id := an.Id
+		steps = append(steps, step{"DeleteBucketAnalyticsConfiguration", func() error {
+			req := client.forBucket(bucket).DeleteBucketAnalyticsConfigurationRequest(&s3.DeleteBucketAnalyticsConfigurationInput{Bucket: &bucket, Id: id})
+			req.SetContext(ctx)
+			_, err := req.Send()
+			return err
+		}})
+	}
+	for _, m := range cfg.Metrics {
+		id := m.Id
+		steps = append(steps, step{"DeleteBucketMetricsConfiguration", func() error {
+			req := client.forBucket(bucket).DeleteBucketMetricsConfigurationRequest(&s3.DeleteBucketMetricsConfigurationInput{Bucket: &bucket, Id: id})
+			req.SetContext(ctx)
+			_, err := req.Send()
+			return err
+		}})
+	}
+	if len(cfg.Tagging) > 0 {
+		steps = append(steps, step{"DeleteBucketTagging", func() error {
+			req := client.forBucket(bucket).DeleteBucketTaggingRequest(&s3.DeleteBucketTaggingInput{Bucket: &bucket})
+			req.SetContext(ctx)
+			_, err := req.Send()
+			return err
+		}})
+	}
+	if cfg.Encryption != nil {
+		steps = append(steps, step{"DeleteBucketEncryption", func() error {
+			req := client.forBucket(bucket).DeleteBucketEncryptionRequest(&s3.DeleteBucketEncryptionInput{Bucket: &bucket})
+			req.SetContext(ctx)
+			_, err := req.Send()
+			return err
+		}})
+	}
+
+	for _, step := range steps {
+		if err := client.call(ctx, step.op, step.send); err != nil && !notConfigured(err) {
+			return &BucketError{Bucket: bucket, Op: step.op, Err: err}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+// Copyright 2018 Sergey Grankin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/sgrankin/s3-purge-bucket/s3util"
+)
+
+// handleSignals returns a context that is cancelled on the first SIGINT or
+// SIGTERM, which stops the purge gracefully: listing stops and in-flight
+// deletes are given the drain timeout to finish.  A second signal exits
+// immediately, after closing the audit log.
+func handleSignals(drain time.Duration) context.Context {
+	ctx, stop := context.WithCancel(context.Background())
+
+	sigs := make(chan os.Signal, 2)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		s3util.LogInfo("interrupted", s3util.Fields{"signal": sig.String(), "drain_timeout": drain.String()},
+			"received %v: finishing in-flight deletes for up to %v; signal again to exit immediately", sig, drain)
+		stop()
+
+		sig = <-sigs
+		s3util.LogInfo("exiting", s3util.Fields{"signal": sig.String()}, "received %v: exiting immediately", sig)
+		closeAuditLog()
+		os.Exit(2)
+	}()
+
+	return ctx
+}
@@ -0,0 +1,39 @@
+// Copyright 2018 Sergey Grankin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sort"
+
+	"github.com/sgrankin/s3-purge-bucket/s3util"
+)
+
+// logDeletedBytes logs the size of the deleted versions by storage class.
+func logDeletedBytes(result *s3util.PurgeResult, dryrun bool) {
+	verb := "deleted"
+	if dryrun {
+		verb = "would have deleted"
+	}
+
+	classes := make([]string, 0, len(result.DeletedBytes))
+	for class := range result.DeletedBytes {
+		classes = append(classes, class)
+	}
+	sort.Strings(classes)
+	for _, class := range classes {
+		s3util.LogInfo("bytes_deleted", s3util.Fields{"storage_class": class, "bytes": result.DeletedBytes[class], "dryrun": dryrun},
+			"%s %d bytes in storage class %s", verb, result.DeletedBytes[class], class)
+	}
+}
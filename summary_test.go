@@ -0,0 +1,52 @@
+// Copyright 2018 Sergey Grankin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/sgrankin/s3-purge-bucket/s3util"
+)
+
+func TestLogDeletedBytes(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	flags := log.Flags()
+	log.SetFlags(0)
+	defer func() {
+		log.SetOutput(os.Stderr)
+		log.SetFlags(flags)
+	}()
+
+	result := &s3util.PurgeResult{DeletedBytes: map[string]int64{"STANDARD": 100, "GLACIER": 205}}
+	logDeletedBytes(result, false)
+	logDeletedBytes(result, true)
+
+	want := `deleted 205 bytes in storage class GLACIER
+deleted 100 bytes in storage class STANDARD
+would have deleted 205 bytes in storage class GLACIER
+would have deleted 100 bytes in storage class STANDARD
+`
+	if got := buf.String(); got != want {
+		t.Errorf("logged:\n%s\nwant:\n%s", got, want)
+	}
+	if strings.Contains(buf.String(), "error") {
+		t.Error("logged an error")
+	}
+}
@@ -0,0 +1,89 @@
+// Copyright 2018 Sergey Grankin
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/sgrankin/s3-purge-bucket/s3util"
+)
+
+var (
+	teardown    = flag.Bool("teardown", false, "save and remove bucket configuration (replication, lifecycle, policy, notifications, ...) before purging")
+	snapshotDir = flag.String("teardown-snapshot-dir", ".", "directory for the bucket configuration snapshots saved by -teardown")
+)
+
+// checkTeardown rejects -teardown where buckets would not be removed.
+func checkTeardown(targets []target) error {
+	if !*teardown {
+		return nil
+	}
+	if !removingBuckets() {
+		return fmt.Errorf("-teardown removes the buckets and can't be combined with filters")
+	}
+	for _, t := range targets {
+		if t.prefix != "" {
+			return fmt.Errorf("-teardown removes the buckets and can't be used with prefix s3://%s/%s", t.bucket, t.prefix)
+		}
+	}
+	return nil
+}
+
+// teardownBuckets snapshots the configuration of each bucket to a file and
+// then strips it, stopping replication and lifecycle first.  With -dryrun,
+// only the snapshots are saved.
+func teardownBuckets(ctx context.Context, targets []target) {
+	for _, bucket := range bucketNames(targets) {
+		cfg, err := client.SnapshotBucketConfig(ctx, bucket)
+		if err != nil {
+			s3util.LogFatal("teardown_failed", s3util.Fields{"bucket": bucket, "error": err}, "%v", err)
+		}
+		path := filepath.Join(*snapshotDir,
+			fmt.Sprintf("%s-config-%s.json", bucket, cfg.TakenAt.Format("20060102T150405Z")))
+		if err := saveSnapshot(path, cfg); err != nil {
+			s3util.LogFatal("teardown_failed", s3util.Fields{"bucket": bucket, "path": path, "error": err},
+				"saving configuration of %s: %v", bucket, err)
+		}
+		s3util.LogInfo("config_saved", s3util.Fields{"bucket": bucket, "path": path}, "saved configuration of %s to %s", bucket, path)
+		if *dryrun {
+			continue
+		}
+
+		if err := client.StopBucketActivity(ctx, bucket); err != nil {
+			s3util.LogFatal("teardown_failed", s3util.Fields{"bucket": bucket, "error": err}, "%v", err)
+		}
+		if err := client.DeleteBucketConfig(ctx, cfg); err != nil {
+			s3util.LogFatal("teardown_failed", s3util.Fields{"bucket": bucket, "error": err}, "%v", err)
+		}
+	}
+}
+
+func saveSnapshot(path string, v interface{}) error {
+	buf, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, append(buf, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}